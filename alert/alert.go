@@ -0,0 +1,210 @@
+// Package alert sends notices about problems which need attention, such as
+// failed uploads, to a separate discord channel or a local command.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/httpclient"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+	"github.com/tardisx/discord-auto-upload/upload"
+)
+
+// maxMessageLength is the most discord allows in a message.
+const maxMessageLength = 2000
+
+// commandTimeout is how long an alert command may run for.
+const commandTimeout = 30 * time.Second
+
+// Alerter collects alerts and sends them, no more often than the configured
+// minimum interval. Alerts which arrive in between are combined into one
+// summary. Repeats of an alert within the de-duplication window are dropped.
+type Alerter struct {
+	lock     sync.Mutex
+	conf     config.AlertConfig
+	pending  []string
+	lastSent time.Time
+	seen     map[string]time.Time // when each alert key was last accepted
+	timer    *time.Timer
+
+	now     func() time.Time
+	deliver func(conf config.AlertConfig, summary string) error
+}
+
+func New() *Alerter {
+	return &Alerter{
+		conf:    config.DefaultAlertConfig(),
+		seen:    make(map[string]time.Time),
+		now:     time.Now,
+		deliver: deliver,
+	}
+}
+
+// Configure applies new alert settings.
+func (a *Alerter) Configure(conf config.AlertConfig) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.conf = conf.WithDefaults()
+}
+
+// Alert queues an alert to be sent. The key identifies the problem, an alert
+// with the same key as one sent recently is ignored. A nil Alerter discards
+// all alerts.
+func (a *Alerter) Alert(key, message string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.conf.WebHookURL == "" && a.conf.Command == "" {
+		return
+	}
+
+	now := a.now()
+	window := time.Duration(a.conf.DedupWindow) * time.Second
+	for k, t := range a.seen {
+		if now.Sub(t) >= window {
+			delete(a.seen, k)
+		}
+	}
+	if _, ok := a.seen[key]; ok {
+		daulog.Debugf("not repeating alert: %s", message)
+		return
+	}
+	a.seen[key] = now
+	a.pending = append(a.pending, message)
+
+	if a.timer == nil {
+		delay := a.lastSent.Add(time.Duration(a.conf.MinInterval) * time.Second).Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		a.timer = time.AfterFunc(delay, a.flush)
+	}
+}
+
+// flush sends all of the pending alerts as a single summary.
+func (a *Alerter) flush() {
+	a.lock.Lock()
+	messages := a.pending
+	a.pending = nil
+	a.timer = nil
+	a.lastSent = a.now()
+	conf := a.conf
+	a.lock.Unlock()
+
+	if len(messages) == 0 {
+		return
+	}
+	err := a.deliver(conf, summary(messages))
+	if err != nil {
+		daulog.Errorf("could not send alert: %s", err)
+	}
+}
+
+func summary(messages []string) string {
+	s := "discord-auto-upload needs attention:\n"
+	if len(messages) > 1 {
+		s = fmt.Sprintf("discord-auto-upload has %d problems which need attention:\n", len(messages))
+	}
+	for _, m := range messages {
+		s += "- " + m + "\n"
+	}
+	return s
+}
+
+// deliver sends a summary to the configured webhook and command.
+func deliver(conf config.AlertConfig, summary string) error {
+	errs := []string{}
+	if conf.WebHookURL != "" {
+		if err := postWebhook(conf.WebHookURL, summary); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if conf.Command != "" {
+		if err := runCommand(conf.Command, summary); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// alertMessage is the message posted to the alert webhook.
+type alertMessage struct {
+	Content         string `json:"content"`
+	Username        string `json:"username"`
+	AllowedMentions struct {
+		Parse []string `json:"parse"`
+	} `json:"allowed_mentions"`
+}
+
+func postWebhook(webhookURL, summary string) error {
+	if utf8.RuneCountInString(summary) > maxMessageLength {
+		summary = string([]rune(summary)[:maxMessageLength-3]) + "..."
+	}
+	msg := alertMessage{Content: summary, Username: "discord-auto-upload"}
+	// filenames and errors are quoted, so nobody can be pinged
+	msg.AllowedMentions.Parse = []string{}
+	body, _ := json.Marshal(msg)
+	resp, err := httpclient.Client().Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not post alert: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("alert webhook returned HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func runCommand(command, summary string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Stdin = strings.NewReader(summary)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("alert command %s failed: %s: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// WatchUploads raises alerts for uploads which fail, in the background.
+func (a *Alerter) WatchUploads(up *upload.Uploader) {
+	events, _ := up.Subscribe()
+	go func() {
+		for e := range events {
+			if e.To != upload.StateFailed {
+				continue
+			}
+			a.Alert("failed:"+e.Filename, fmt.Sprintf("upload of %s failed: %s", e.Filename, e.Reason))
+
+			ul := up.UploadById(e.Upload)
+			if ul == nil {
+				continue
+			}
+			for _, d := range ul.RejectedWebhooks() {
+				a.Alert("webhook:"+e.Watcher+":"+d.Name,
+					fmt.Sprintf("discord rejected %s for watcher %s: %s", d.Name, e.Watcher, d.StateReason))
+			}
+		}
+	}()
+}
+
+// MissingPath raises an alert for a watcher whose directory cannot be used.
+func (a *Alerter) MissingPath(path string, err error) {
+	a.Alert("path:"+path, fmt.Sprintf("cannot watch %s: %s", path, err))
+}
@@ -0,0 +1,161 @@
+package alert
+
+import (
+	"encoding/json"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/upload"
+)
+
+type recorder struct {
+	lock  sync.Mutex
+	sent  []string
+	ready chan bool
+}
+
+func (r *recorder) deliver(conf config.AlertConfig, summary string) error {
+	r.lock.Lock()
+	r.sent = append(r.sent, summary)
+	r.lock.Unlock()
+	r.ready <- true
+	return nil
+}
+
+func testAlerter(minInterval int) (*Alerter, *recorder) {
+	r := &recorder{ready: make(chan bool, 10)}
+	a := New()
+	a.deliver = r.deliver
+	a.Configure(config.AlertConfig{Command: "true", MinInterval: minInterval, DedupWindow: 3600})
+	return a, r
+}
+
+func TestAlertsCombined(t *testing.T) {
+	a, r := testAlerter(1)
+	a.Alert("one", "first problem")
+	<-r.ready
+
+	// these arrive within the minimum interval, so are sent together
+	a.Alert("two", "second problem")
+	a.Alert("three", "third problem")
+	select {
+	case <-r.ready:
+	case <-time.After(3 * time.Second):
+		t.Fatal("combined alert not sent")
+	}
+
+	if len(r.sent) != 2 {
+		t.Fatalf("expected 2 alerts, got %d", len(r.sent))
+	}
+	if !strings.Contains(r.sent[1], "2 problems") || !strings.Contains(r.sent[1], "- third problem") {
+		t.Errorf("unexpected summary %s", r.sent[1])
+	}
+}
+
+func TestAlertsDeduplicated(t *testing.T) {
+	a, r := testAlerter(0)
+	a.Alert("path:/tmp/x", "cannot watch /tmp/x")
+	<-r.ready
+	a.Alert("path:/tmp/x", "cannot watch /tmp/x")
+	select {
+	case <-r.ready:
+		t.Error("repeated alert should not be sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// once the window has passed, it is sent again
+	a.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	a.Alert("path:/tmp/x", "cannot watch /tmp/x")
+	<-r.ready
+}
+
+func TestAlertsDisabled(t *testing.T) {
+	a, r := testAlerter(0)
+	a.Configure(config.AlertConfig{})
+	a.Alert("one", "problem")
+	select {
+	case <-r.ready:
+		t.Error("alert sent with nowhere configured to send it")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type rejectingClient struct{}
+
+func (c rejectingClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: 404, Body: ioutil.NopCloser(strings.NewReader(`{"message": "Unknown Webhook", "code": 10015}`))}, nil
+}
+
+func TestWatchUploads(t *testing.T) {
+	f, _ := ioutil.TempFile("", "dautest-alert-*.png")
+	png.Encode(f, image.NewRGBA(image.Rect(0, 0, 16, 16)))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	a, r := testAlerter(0)
+	up := upload.NewUploader()
+	a.WatchUploads(up)
+	up.AddFile(f.Name(), config.Watcher{Path: "/screenshots", WebHookURL: "https://127.0.0.1/", NoWatermark: true})
+	up.Uploads[0].Client = rejectingClient{}
+	up.Upload()
+
+	all := ""
+	for !strings.Contains(all, "discord rejected webhook 1 for watcher /screenshots") || !strings.Contains(all, "failed") {
+		select {
+		case <-r.ready:
+			r.lock.Lock()
+			all = strings.Join(r.sent, "")
+			r.lock.Unlock()
+		case <-time.After(3 * time.Second):
+			t.Fatalf("expected alerts not sent, got %s", all)
+		}
+	}
+}
+
+func TestPostWebhookTruncates(t *testing.T) {
+	var posted alertMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&posted)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	// every character is several bytes, so cutting by bytes would split one
+	summary := strings.Repeat("アップロード失敗 ", 300)
+	if err := postWebhook(server.URL, summary); err != nil {
+		t.Fatal(err)
+	}
+	content := posted.Content
+	if n := utf8.RuneCountInString(content); n != maxMessageLength {
+		t.Errorf("expected %d characters, got %d", maxMessageLength, n)
+	}
+	if !strings.HasSuffix(content, "...") || !strings.HasPrefix(summary, strings.TrimSuffix(content, "...")) {
+		t.Errorf("summary was not cut at a character, ends %q", content[len(content)-12:])
+	}
+}
+
+func TestPostWebhookNoMentions(t *testing.T) {
+	var posted []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posted, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	if err := postWebhook(server.URL, "upload of @everyone.png failed"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(posted), `"allowed_mentions":{"parse":[]}`) {
+		t.Errorf("mentions are not disabled in %s", posted)
+	}
+}
@@ -1,12 +1,21 @@
 package config
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/tardisx/discord-auto-upload/image"
 	daulog "github.com/tardisx/discord-auto-upload/log"
 
 	"github.com/mitchellh/go-homedir"
@@ -27,8 +36,435 @@ type Watcher struct {
 	Path        string
 	Username    string
 	NoWatermark bool
+	Watermark   WatermarkConfig
 	HoldUploads bool
 	Exclude     []string
+	Retry       RetryPolicy
+
+	// FilenameTemplate is the name given to the file on discord, see
+	// image.Store.UploadFilename. It defaults to "image".
+	FilenameTemplate string
+	Spoiler          bool
+
+	// ConvertPNGToJPEG lets opaque PNGs which are too big for discord be
+	// sent as JPEGs, rather than being scaled down
+	ConvertPNGToJPEG bool
+
+	// Metadata says which metadata is removed from files before they are
+	// uploaded: "safe" (the default) keeps only the orientation and colour
+	// profile, "strip" removes everything and "keep" removes nothing
+	Metadata string
+
+	UploadRateLimit int64 // bytes per second for this watcher's uploads, 0 for unlimited
+	DryRun          bool  // write this watcher's uploads to disk instead of sending them, see ConfigV3.DryRunDir
+
+	AvatarURL string
+	// AllowedMentions are the types of mention which may ping people,
+	// any of "users", "roles" and "everyone". Empty means nobody is pinged.
+	AllowedMentions       []string
+	SuppressEmbeds        bool
+	SuppressNotifications bool
+
+	// ExtraDestinations are additional webhooks which receive a copy of
+	// every upload, alongside WebHookURL
+	ExtraDestinations []Destination
+
+	// Rules can send files to a different webhook than WebHookURL. They
+	// are checked in order, and the first match wins.
+	Rules []RoutingRule
+
+	// Redactions hide the same parts of every image, such as a corner of
+	// a game's HUD showing the player's name
+	Redactions []RedactionRegion
+
+	// Transform crops, scales, rotates and flips every image
+	Transform TransformConfig
+
+	// Duplicates decides what happens to images which look almost the
+	// same as one recently found by this watcher
+	Duplicates DuplicatePolicy
+
+	// Collage posts a contact sheet of the images when many are found at
+	// once
+	Collage CollagePolicy
+}
+
+// CollagePolicy makes a contact sheet of the images a watcher finds at the
+// same time, such as a dump of screenshots. Zero values are replaced by the
+// defaults, see WithDefaults.
+type CollagePolicy struct {
+	Mode      string // "before" or "instead" of the images themselves, empty for no collage
+	MinImages int    // how many images must be found together to make a collage
+	Columns   int    // images across, 0 for a roughly square sheet
+	CellSize  int    // width of each image in pixels
+	Captions  bool   // write the name of each file under its image
+}
+
+// DefaultCollagePolicy is the collage policy of new watchers.
+func DefaultCollagePolicy() CollagePolicy {
+	return CollagePolicy{
+		MinImages: 10,
+		CellSize:  320,
+	}
+}
+
+// WithDefaults returns a copy of the policy with any unset values replaced
+// by those from DefaultCollagePolicy.
+func (c CollagePolicy) WithDefaults() CollagePolicy {
+	def := DefaultCollagePolicy()
+	if c.MinImages == 0 {
+		c.MinImages = def.MinImages
+	}
+	if c.CellSize == 0 {
+		c.CellSize = def.CellSize
+	}
+	return c
+}
+
+// Validate checks the collage policy.
+func (c CollagePolicy) Validate() error {
+	if c.Mode != "" && c.Mode != "before" && c.Mode != "instead" {
+		return fmt.Errorf("mode should be before, instead or empty - '%s' invalid", c.Mode)
+	}
+	if c.MinImages < 0 || c.MinImages == 1 {
+		return fmt.Errorf("a collage needs at least 2 images - '%d' invalid", c.MinImages)
+	}
+	if c.Columns < 0 || c.Columns > 50 {
+		return fmt.Errorf("columns should be between 0 and 50 - '%d' invalid", c.Columns)
+	}
+	if c.CellSize < 0 || c.CellSize > 2000 {
+		return fmt.Errorf("image width should be between 0 and 2000 - '%d' invalid", c.CellSize)
+	}
+	return nil
+}
+
+// DuplicatePolicy finds images which look almost the same as an earlier
+// one, such as repeated screenshots of a menu, by comparing a perceptual
+// hash of each image. A zero Recent is replaced by the default, see
+// WithDefaults.
+type DuplicatePolicy struct {
+	Action    string // "skip" or "hold" near duplicates, empty to upload them as usual
+	Threshold int    // how many of the 64 bits of the hashes may differ, 0 for images that look identical
+	Recent    int    // how many earlier images from the watcher to compare with
+}
+
+// DefaultDuplicatePolicy is the duplicate policy of new watchers.
+func DefaultDuplicatePolicy() DuplicatePolicy {
+	return DuplicatePolicy{
+		Threshold: 6,
+		Recent:    20,
+	}
+}
+
+// WithDefaults returns a copy of the policy with any unset values replaced
+// by those from DefaultDuplicatePolicy.
+func (d DuplicatePolicy) WithDefaults() DuplicatePolicy {
+	if d.Recent == 0 {
+		d.Recent = DefaultDuplicatePolicy().Recent
+	}
+	return d
+}
+
+// Validate checks the duplicate policy.
+func (d DuplicatePolicy) Validate() error {
+	if d.Action != "" && d.Action != "skip" && d.Action != "hold" {
+		return fmt.Errorf("action should be skip, hold or empty - '%s' invalid", d.Action)
+	}
+	if d.Threshold < 0 || d.Threshold > 64 {
+		return fmt.Errorf("threshold should be between 0 and 64 - '%d' invalid", d.Threshold)
+	}
+	if d.Recent < 0 {
+		return fmt.Errorf("number of recent images cannot be negative - '%d' invalid", d.Recent)
+	}
+	return nil
+}
+
+// TransformConfig changes the shape and size of images before they are
+// uploaded. The steps are applied in the order of the fields.
+type TransformConfig struct {
+	// CropX, CropY, CropWidth and CropHeight keep part of the image, as
+	// fractions of its size. Ignored if the width or height is 0.
+	CropX, CropY, CropWidth, CropHeight float64
+	TrimBorders                         bool   // remove rows and columns of a single colour from the edges
+	AspectRatio                         string // like "16:9", crops the middle of the image to this shape
+	Rotate                              int    // degrees clockwise: 0, 90, 180 or 270
+	FlipH, FlipV                        bool
+	MaxDimension                        int // scales the image down so neither side is longer, 0 for no limit
+}
+
+// Validate checks the transform settings.
+func (t TransformConfig) Validate() error {
+	return t.Image().Validate()
+}
+
+// Image returns the transform as the image package applies it.
+func (t TransformConfig) Image() image.Transform {
+	return image.Transform{
+		CropX:        t.CropX,
+		CropY:        t.CropY,
+		CropWidth:    t.CropWidth,
+		CropHeight:   t.CropHeight,
+		TrimBorders:  t.TrimBorders,
+		AspectRatio:  t.AspectRatio,
+		Rotate:       t.Rotate,
+		FlipH:        t.FlipH,
+		FlipV:        t.FlipV,
+		MaxDimension: t.MaxDimension,
+	}
+}
+
+// RedactionRegion is an area of an image to hide. The position and size
+// are fractions of the image's width and height, so 0.5 is half way.
+type RedactionRegion struct {
+	X, Y, Width, Height float64
+	Mode                string // blur, pixelate or fill
+	Colour              string // for fill, as #rrggbb, black if empty
+}
+
+// Validate checks the region is within the image and has a known mode.
+func (r RedactionRegion) Validate() error {
+	return r.Image().Validate(true)
+}
+
+// Image returns the region as the image package applies it.
+func (r RedactionRegion) Image() image.Redaction {
+	return image.Redaction{X: r.X, Y: r.Y, Width: r.Width, Height: r.Height, Mode: r.Mode, Colour: r.Colour}
+}
+
+// WatermarkConfig changes how the watermark looks. The zero value is the
+// project's own watermark.
+type WatermarkConfig struct {
+	Text       string  // may contain {name}, {safename}, {date} and {time}, see Watcher.FilenameTemplate
+	Position   string  // one of WatermarkPositions, bottom-left if empty
+	Scale      float64 // height of the text as a fraction of the shorter side of the image, 0 for small text of a fixed size
+	Foreground string  // colour of the text as #rrggbb or #rrggbbaa, white if empty
+	Background string  // colour of the bar behind the text, black if empty
+	Logo       string  // optional PNG file, drawn before the text
+}
+
+// WatermarkPositions are the places the watermark can go.
+var WatermarkPositions = []string{
+	"top-left", "top", "top-right",
+	"left", "center", "right",
+	"bottom-left", "bottom", "bottom-right",
+}
+
+// watermarkColour matches the colours used by watermarks
+var watermarkColour = regexp.MustCompile(`^#([0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+// Validate checks the watermark settings.
+func (w WatermarkConfig) Validate() error {
+	if w.Position != "" {
+		found := false
+		for _, p := range WatermarkPositions {
+			found = found || p == w.Position
+		}
+		if !found {
+			return fmt.Errorf("watermark position should be one of %s - '%s' invalid", strings.Join(WatermarkPositions, ", "), w.Position)
+		}
+	}
+	if w.Scale < 0 || w.Scale > 0.5 {
+		return fmt.Errorf("watermark scale should be between 0 and 0.5 - '%g' invalid", w.Scale)
+	}
+	for _, c := range []string{w.Foreground, w.Background} {
+		if c != "" && !watermarkColour.MatchString(c) {
+			return fmt.Errorf("watermark colour should look like #rrggbb or #rrggbbaa - '%s' invalid", c)
+		}
+	}
+	if w.Logo != "" {
+		info, err := os.Stat(w.Logo)
+		if err != nil {
+			return fmt.Errorf("watermark logo '%s' cannot be read: %s", w.Logo, err)
+		}
+		if info.IsDir() {
+			return fmt.Errorf("watermark logo '%s' is a directory", w.Logo)
+		}
+	}
+	return nil
+}
+
+// Image returns the settings as the image package applies them.
+func (w WatermarkConfig) Image() image.WatermarkOptions {
+	return image.WatermarkOptions{
+		Text:       w.Text,
+		Position:   w.Position,
+		Scale:      w.Scale,
+		Foreground: w.Foreground,
+		Background: w.Background,
+		Logo:       w.Logo,
+	}
+}
+
+// RoutingRule replaces the watcher's WebHookURL for the files it matches.
+// Every condition which is set must match for the rule to apply.
+type RoutingRule struct {
+	Name string // optional, for display only
+
+	// Pattern is a glob matched against the end of the path, using '/' as
+	// the separator. "*/Elden Ring/*" matches any file in a directory
+	// called "Elden Ring", "*.jpg" matches any jpeg.
+	Pattern string
+
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+
+	// StartTime and EndTime are local times of day, like "18:00". If EndTime
+	// is before StartTime the period spans midnight.
+	StartTime string
+	EndTime   string
+
+	WebHookURL string
+}
+
+// ValidWebhookURL checks that a webhook URL looks reasonable. Plain HTTP is
+// allowed for a local server, standing in for discord while testing.
+func ValidWebhookURL(webhookURL string) bool {
+	if strings.Index(webhookURL, "https://") == 0 {
+		return true
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Scheme != "http" {
+		return false
+	}
+	host := u.Hostname()
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// TimeOfDayFormat is the format of RoutingRule StartTime and EndTime.
+const TimeOfDayFormat = "15:04"
+
+// Validate checks the rule is usable.
+func (r RoutingRule) Validate() error {
+	if !ValidWebhookURL(r.WebHookURL) {
+		return fmt.Errorf("webhook URL '%s' does not look valid", r.WebHookURL)
+	}
+	if _, err := path.Match(r.Pattern, ""); err != nil {
+		return fmt.Errorf("pattern '%s' is not valid: %s", r.Pattern, err)
+	}
+	if r.MinWidth < 0 || r.MinHeight < 0 || r.MaxWidth < 0 || r.MaxHeight < 0 {
+		return errors.New("image dimensions cannot be negative")
+	}
+	if (r.StartTime == "") != (r.EndTime == "") {
+		return errors.New("both start and end time must be set")
+	}
+	for _, t := range []string{r.StartTime, r.EndTime} {
+		if t == "" {
+			continue
+		}
+		if _, err := time.Parse(TimeOfDayFormat, t); err != nil {
+			return fmt.Errorf("time '%s' should look like 18:30", t)
+		}
+	}
+	return nil
+}
+
+// Destination is a webhook that uploads are sent to.
+type Destination struct {
+	Name       string // optional, for display only
+	WebHookURL string
+}
+
+// AllDestinations returns every destination this watcher uploads to, starting
+// with the primary WebHookURL.
+func (w Watcher) AllDestinations() []Destination {
+	dests := []Destination{{WebHookURL: w.WebHookURL}}
+	return append(dests, w.ExtraDestinations...)
+}
+
+// Validate checks the watcher is usable: that its directory exists, its
+// webhooks look right and all of its settings are valid.
+func (w Watcher) Validate() error {
+	// the sample watcher of a new configuration gets a pass
+	if w.Path != "/your/screenshot/dir/here" {
+		info, err := os.Stat(w.Path)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("path '%s' does not exist", w.Path)
+		}
+		if err != nil {
+			return fmt.Errorf("path '%s' cannot be read: %s", w.Path, err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("path '%s' is not a directory", w.Path)
+		}
+	}
+
+	for _, dest := range w.AllDestinations() {
+		if !ValidWebhookURL(dest.WebHookURL) {
+			return fmt.Errorf("webhook URL '%s' does not look valid", dest.WebHookURL)
+		}
+	}
+	for i, rule := range w.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("rule %d is invalid: %s", i+1, err)
+		}
+	}
+
+	if w.AvatarURL != "" && !strings.HasPrefix(w.AvatarURL, "https://") && !strings.HasPrefix(w.AvatarURL, "http://") {
+		return fmt.Errorf("avatar URL '%s' does not look valid", w.AvatarURL)
+	}
+	seen := map[string]bool{}
+	for _, mention := range w.AllowedMentions {
+		if mention != "users" && mention != "roles" && mention != "everyone" {
+			return fmt.Errorf("allowed mention should be one of users, roles or everyone - '%s' invalid", mention)
+		}
+		if seen[mention] {
+			return fmt.Errorf("allowed mention '%s' is listed twice", mention)
+		}
+		seen[mention] = true
+	}
+
+	if err := w.Watermark.Validate(); err != nil {
+		return fmt.Errorf("watermark is invalid: %s", err)
+	}
+	if err := w.Transform.Validate(); err != nil {
+		return fmt.Errorf("transform is invalid: %s", err)
+	}
+	for i, region := range w.Redactions {
+		if err := region.Validate(); err != nil {
+			return fmt.Errorf("redaction %d is invalid: %s", i+1, err)
+		}
+	}
+	if err := w.Duplicates.Validate(); err != nil {
+		return fmt.Errorf("duplicate settings are invalid: %s", err)
+	}
+	if err := w.Collage.Validate(); err != nil {
+		return fmt.Errorf("collage settings are invalid: %s", err)
+	}
+
+	switch w.Metadata {
+	case "", "safe", "strip", "keep":
+	default:
+		return fmt.Errorf("metadata policy should be one of safe, strip or keep - '%s' invalid", w.Metadata)
+	}
+	if err := w.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry settings are invalid: %s", err)
+	}
+	if w.UploadRateLimit < 0 {
+		return fmt.Errorf("upload rate limit cannot be negative - '%d' invalid", w.UploadRateLimit)
+	}
+	return nil
+}
+
+// RetryPolicy determines how often, and how quickly, a failed upload is
+// retried. Zero values are replaced by the defaults, see WithDefaults.
+type RetryPolicy struct {
+	Attempts  int     // total number of attempts, including the first
+	BaseDelay int     // seconds to wait before the first retry, doubled for each subsequent retry
+	MaxDelay  int     // maximum seconds to wait between retries
+	Jitter    float64 // randomise each delay by up to this fraction (0-1)
+}
+
+// Validate checks the retry settings.
+func (r RetryPolicy) Validate() error {
+	if r.Attempts < 0 || r.BaseDelay < 0 || r.MaxDelay < 0 {
+		return errors.New("attempts and delays cannot be negative")
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		return fmt.Errorf("jitter should be between 0 and 1 - '%g' invalid", r.Jitter)
+	}
+	return nil
 }
 
 type ConfigV2 struct {
@@ -43,9 +479,115 @@ type ConfigV3 struct {
 	Version            int
 	Port               int
 	OpenBrowserOnStart bool
+	ValidateWebhooks   bool // check new or changed webhooks with discord when saving
+	HTTP               HTTPConfig
+	UploadRateLimit    int64  // bytes per second for all uploads combined, 0 for unlimited
+	DryRun             bool   // write uploads to DryRunDir instead of sending them to discord
+	DryRunDir          string // defaults to a directory in the system temporary directory
+	Retention          RetentionPolicy
+	Alerts             AlertConfig
 	Watchers           []Watcher
 }
 
+// AlertConfig configures where alerts about problems are sent. Alerts are
+// only sent if a webhook or command is set. Zero intervals are replaced by
+// the defaults, see WithDefaults.
+type AlertConfig struct {
+	WebHookURL  string // discord webhook to post alerts to
+	Command     string // program to run for each alert, given the alert on stdin
+	MinInterval int    // minimum seconds between alerts, alerts in between are combined
+	DedupWindow int    // seconds during which a repeat of the same alert is not sent
+}
+
+// RetentionPolicy determines how long finished uploads are kept in the list
+// of uploads, before being moved to the history. Zero values are replaced
+// by the defaults, see WithDefaults.
+type RetentionPolicy struct {
+	MaxCount int // maximum number of finished uploads to keep, not counting failed ones which can be retried
+	MaxAge   int // minutes to keep a finished upload
+}
+
+// HTTPConfig configures the client used for all outgoing requests. Zero
+// values are replaced by the defaults, see WithDefaults.
+type HTTPConfig struct {
+	ProxyURL       string // if empty, the HTTP_PROXY/HTTPS_PROXY environment variables are used
+	CAFile         string // PEM file of extra certificate authorities to trust
+	TLSMinVersion  string // one of 1.0, 1.1, 1.2 or 1.3
+	ConnectTimeout int    // seconds to wait for a connection to be established
+	Timeout        int    // seconds to wait for a whole request, including the upload
+	KeepAlive      int    // seconds between keep-alive probes, negative disables keep-alive
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// DefaultHTTPConfig is the HTTP configuration used when none is configured.
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		TLSMinVersion:  "1.2",
+		ConnectTimeout: 10,
+		Timeout:        30,
+		KeepAlive:      30,
+	}
+}
+
+// WithDefaults returns a copy of the configuration with any unset values
+// replaced by those from DefaultHTTPConfig.
+func (h HTTPConfig) WithDefaults() HTTPConfig {
+	def := DefaultHTTPConfig()
+	if h.TLSMinVersion == "" {
+		h.TLSMinVersion = def.TLSMinVersion
+	}
+	if h.ConnectTimeout == 0 {
+		h.ConnectTimeout = def.ConnectTimeout
+	}
+	if h.Timeout == 0 {
+		h.Timeout = def.Timeout
+	}
+	if h.KeepAlive == 0 {
+		h.KeepAlive = def.KeepAlive
+	}
+	return h
+}
+
+// TLSVersion returns the crypto/tls constant for the minimum TLS version.
+func (h HTTPConfig) TLSVersion() (uint16, error) {
+	v, ok := tlsVersions[h.WithDefaults().TLSMinVersion]
+	if !ok {
+		return 0, fmt.Errorf("TLS version '%s' should be one of 1.0, 1.1, 1.2 or 1.3", h.TLSMinVersion)
+	}
+	return v, nil
+}
+
+// Validate checks the HTTP configuration is usable.
+func (h HTTPConfig) Validate() error {
+	if h.ProxyURL != "" {
+		u, err := url.Parse(h.ProxyURL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("proxy URL '%s' does not look valid", h.ProxyURL)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+			return fmt.Errorf("proxy URL '%s' should be http, https or socks5", h.ProxyURL)
+		}
+	}
+	if h.CAFile != "" {
+		if _, err := os.Stat(h.CAFile); err != nil {
+			return fmt.Errorf("CA file '%s' cannot be read: %s", h.CAFile, err)
+		}
+	}
+	if _, err := h.TLSVersion(); err != nil {
+		return err
+	}
+	if h.ConnectTimeout < 0 || h.Timeout < 0 {
+		return errors.New("HTTP timeouts cannot be negative")
+	}
+	return nil
+}
+
 type ConfigService struct {
 	Config         *ConfigV3
 	Changed        chan bool
@@ -59,6 +601,12 @@ func DefaultConfigService() *ConfigService {
 	return &c
 }
 
+// HistoryFilename returns the path of the upload history database, which
+// lives alongside the config file.
+func (c *ConfigService) HistoryFilename() string {
+	return strings.TrimSuffix(c.ConfigFilename, filepath.Ext(c.ConfigFilename)) + "-history.db"
+}
+
 // LoadOrInit loads the current configuration from the config file, or creates
 // a new config file if none exists.
 func (c *ConfigService) LoadOrInit() error {
@@ -74,18 +622,114 @@ func (c *ConfigService) LoadOrInit() error {
 	}
 }
 
+// DefaultRetryPolicy is the retry policy used when none is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:  5,
+		BaseDelay: 10,
+		MaxDelay:  60,
+		Jitter:    0.1,
+	}
+}
+
+// WithDefaults returns a copy of the policy with any unset values replaced
+// by those from DefaultRetryPolicy.
+func (r RetryPolicy) WithDefaults() RetryPolicy {
+	def := DefaultRetryPolicy()
+	if r.Attempts == 0 {
+		r.Attempts = def.Attempts
+	}
+	if r.BaseDelay == 0 {
+		r.BaseDelay = def.BaseDelay
+	}
+	if r.MaxDelay == 0 {
+		r.MaxDelay = def.MaxDelay
+	}
+	return r
+}
+
+// DefaultRetentionPolicy is the retention policy used when none is configured.
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		MaxCount: 100,
+		MaxAge:   24 * 60,
+	}
+}
+
+// WithDefaults returns a copy of the policy with any unset values replaced
+// by those from DefaultRetentionPolicy.
+func (r RetentionPolicy) WithDefaults() RetentionPolicy {
+	def := DefaultRetentionPolicy()
+	if r.MaxCount == 0 {
+		r.MaxCount = def.MaxCount
+	}
+	if r.MaxAge == 0 {
+		r.MaxAge = def.MaxAge
+	}
+	return r
+}
+
+// DefaultAlertConfig is the alert configuration used when none is configured.
+func DefaultAlertConfig() AlertConfig {
+	return AlertConfig{
+		MinInterval: 60,
+		DedupWindow: 60 * 60,
+	}
+}
+
+// WithDefaults returns a copy of the configuration with any unset values
+// replaced by those from DefaultAlertConfig.
+func (a AlertConfig) WithDefaults() AlertConfig {
+	def := DefaultAlertConfig()
+	if a.MinInterval == 0 {
+		a.MinInterval = def.MinInterval
+	}
+	if a.DedupWindow == 0 {
+		a.DedupWindow = def.DedupWindow
+	}
+	return a
+}
+
+// Validate checks the alert configuration.
+func (a AlertConfig) Validate() error {
+	if a.WebHookURL != "" && !ValidWebhookURL(a.WebHookURL) {
+		return fmt.Errorf("alert webhook URL '%s' does not look valid", a.WebHookURL)
+	}
+	if a.Command != "" {
+		if _, err := exec.LookPath(a.Command); err != nil {
+			return fmt.Errorf("alert command '%s' cannot be run: %s", a.Command, err)
+		}
+	}
+	if a.MinInterval < 0 || a.DedupWindow < 0 {
+		return fmt.Errorf("alert intervals cannot be negative")
+	}
+	return nil
+}
+
 func DefaultConfig() *ConfigV3 {
 	c := ConfigV3{}
 	c.Version = 3
 	c.WatchInterval = 10
 	c.Port = 9090
 	c.OpenBrowserOnStart = true
+	c.HTTP = DefaultHTTPConfig()
+	c.Retention = DefaultRetentionPolicy()
+	c.Alerts = DefaultAlertConfig()
 	w := Watcher{
 		WebHookURL:  "https://webhook.url.here",
 		Path:        "/your/screenshot/dir/here",
 		Username:    "",
 		NoWatermark: false,
 		Exclude:     []string{},
+		Retry:       DefaultRetryPolicy(),
+		Metadata:    "safe",
+
+		AllowedMentions:   []string{},
+		ExtraDestinations: []Destination{},
+		Rules:             []RoutingRule{},
+		Redactions:        []RedactionRegion{},
+		Duplicates:        DefaultDuplicatePolicy(),
+		Collage:           DefaultCollagePolicy(),
 	}
 	c.Watchers = []Watcher{w}
 	return &c
@@ -145,26 +789,34 @@ func (c *ConfigService) Save() error {
 	daulog.Info("saving configuration")
 	// sanity checks
 	for _, watcher := range c.Config.Watchers {
-
-		// give the sample one a pass? this is kinda gross...
-		if watcher.Path == "/your/screenshot/dir/here" {
-			continue
-		}
-		info, err := os.Stat(watcher.Path)
-		if os.IsNotExist(err) {
-			return fmt.Errorf("path '%s' does not exist", watcher.Path)
-		}
-		if !info.IsDir() {
-			return fmt.Errorf("path '%s' is not a directory", watcher.Path)
+		if err := watcher.Validate(); err != nil {
+			return fmt.Errorf("watcher for '%s' is invalid: %s", watcher.Path, err)
 		}
 	}
 
-	for _, watcher := range c.Config.Watchers {
-		if strings.Index(watcher.WebHookURL, "https://") != 0 {
-			return fmt.Errorf("webhook URL '%s' does not look valid", watcher.WebHookURL)
+	if err := c.Config.HTTP.Validate(); err != nil {
+		return err
+	}
+
+	if c.Config.DryRunDir != "" {
+		info, err := os.Stat(c.Config.DryRunDir)
+		if err == nil && !info.IsDir() {
+			return fmt.Errorf("dry run path '%s' is not a directory", c.Config.DryRunDir)
 		}
 	}
 
+	if c.Config.UploadRateLimit < 0 {
+		return fmt.Errorf("upload rate limit cannot be negative - '%d' invalid", c.Config.UploadRateLimit)
+	}
+
+	if c.Config.Retention.MaxCount < 0 || c.Config.Retention.MaxAge < 0 {
+		return fmt.Errorf("upload retention settings cannot be negative")
+	}
+
+	if err := c.Config.Alerts.Validate(); err != nil {
+		return err
+	}
+
 	if c.Config.WatchInterval < 1 {
 		return fmt.Errorf("watch interval should be greater than 0 - '%d' invalid", c.Config.WatchInterval)
 	}
@@ -3,6 +3,7 @@ package config
 import (
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -76,6 +77,223 @@ func TestMigrateFromV1toV3(t *testing.T) {
 	}
 }
 
+func TestWatcherValidation(t *testing.T) {
+	file := emptyTempFile()
+	defer os.Remove(file)
+
+	good := Watcher{Path: t.TempDir(), WebHookURL: "https://discord.com/api/webhooks/1/abc"}
+	if err := good.Validate(); err != nil {
+		t.Errorf("watcher should be valid: %s", err)
+	}
+	bad := []Watcher{good, good, good, good, good}
+	bad[0].Path = "/nonexistent/dau"
+	bad[1].Path = file
+	bad[2].ExtraDestinations = []Destination{{WebHookURL: "discord.com/api/webhooks/2/def"}}
+	bad[3].UploadRateLimit = -1
+	bad[4].Retry.Jitter = 2
+	for _, w := range bad {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", w)
+		}
+	}
+
+	c := ConfigService{ConfigFilename: emptyTempFile()}
+	defer os.Remove(c.ConfigFilename)
+	c.Config = DefaultConfig()
+	c.Config.Watchers = []Watcher{good, bad[3]}
+	err := c.Save()
+	if err == nil || !strings.HasPrefix(err.Error(), "watcher for '"+good.Path+"' is invalid: upload rate limit") {
+		t.Errorf("unexpected error saving an invalid watcher: %v", err)
+	}
+}
+
+func TestRetryPolicyValidation(t *testing.T) {
+	c := ConfigService{}
+	c.ConfigFilename = emptyTempFile()
+	defer os.Remove(c.ConfigFilename)
+
+	c.Config = DefaultConfig()
+	c.Config.Watchers[0].Retry.Jitter = 1.5
+	if err := c.Save(); err == nil {
+		t.Error("jitter over 1 should not be allowed")
+	}
+
+	c.Config.Watchers[0].Retry = RetryPolicy{Attempts: -1}
+	if err := c.Save(); err == nil {
+		t.Error("negative attempts should not be allowed")
+	}
+
+	c.Config.Watchers[0].Retry = RetryPolicy{}
+	if err := c.Save(); err != nil {
+		t.Errorf("empty retry policy should be allowed: %s", err)
+	}
+	r := c.Config.Watchers[0].Retry.WithDefaults()
+	if r.Attempts != 5 || r.BaseDelay != 10 || r.MaxDelay != 60 {
+		t.Errorf("defaults not applied: %#v", r)
+	}
+}
+
+func TestAllowedMentionsValidation(t *testing.T) {
+	c := ConfigService{}
+	c.ConfigFilename = emptyTempFile()
+	defer os.Remove(c.ConfigFilename)
+
+	c.Config = DefaultConfig()
+	c.Config.Watchers[0].AllowedMentions = []string{"users", "here"}
+	if err := c.Save(); err == nil {
+		t.Error("unknown mention type should not be allowed")
+	}
+	c.Config.Watchers[0].AllowedMentions = []string{"users", "roles"}
+	if err := c.Save(); err != nil {
+		t.Errorf("valid mention types should be allowed: %s", err)
+	}
+}
+
+func TestMetadataValidation(t *testing.T) {
+	c := ConfigService{}
+	c.ConfigFilename = emptyTempFile()
+	defer os.Remove(c.ConfigFilename)
+
+	c.Config = DefaultConfig()
+	c.Config.Watchers[0].Metadata = "some"
+	if err := c.Save(); err == nil {
+		t.Error("unknown metadata policy should not be allowed")
+	}
+	for _, policy := range []string{"", "safe", "strip", "keep"} {
+		c.Config.Watchers[0].Metadata = policy
+		if err := c.Save(); err != nil {
+			t.Errorf("metadata policy '%s' should be allowed: %s", policy, err)
+		}
+	}
+}
+
+func TestWatermarkValidation(t *testing.T) {
+	logo := emptyTempFile()
+	defer os.Remove(logo)
+
+	good := []WatermarkConfig{
+		{},
+		{Text: "{name}", Position: "top-right", Scale: 0.05, Foreground: "#ffffff", Background: "#00000080", Logo: logo},
+	}
+	for _, w := range good {
+		if err := w.Validate(); err != nil {
+			t.Errorf("%#v should be valid: %s", w, err)
+		}
+	}
+	bad := []WatermarkConfig{
+		{Position: "middle"},
+		{Scale: -1},
+		{Scale: 0.8},
+		{Foreground: "white"},
+		{Background: "#12345"},
+		{Logo: "/does/not/exist.png"},
+	}
+	for _, w := range bad {
+		if err := w.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", w)
+		}
+	}
+}
+
+func TestRedactionRegionValidation(t *testing.T) {
+	if err := (RedactionRegion{X: 0.8, Y: 0, Width: 0.2, Height: 0.1, Mode: "blur"}).Validate(); err != nil {
+		t.Errorf("region should be valid: %s", err)
+	}
+	bad := []RedactionRegion{
+		{X: 0, Y: 0, Width: 0.2, Height: 0.1, Mode: "smudge"},
+		{X: 0.9, Y: 0, Width: 0.2, Height: 0.1, Mode: "blur"},
+		{X: 0, Y: 0, Width: 0, Height: 0.1, Mode: "pixelate"},
+		{X: 0, Y: 0, Width: 0.1, Height: 0.1, Mode: "fill", Colour: "black"},
+	}
+	for _, r := range bad {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", r)
+		}
+	}
+}
+
+func TestTransformValidation(t *testing.T) {
+	good := TransformConfig{CropX: 0.1, CropY: 0.1, CropWidth: 0.8, CropHeight: 0.8, AspectRatio: "16:9", Rotate: 90, MaxDimension: 1920}
+	if err := good.Validate(); err != nil {
+		t.Errorf("transform should be valid: %s", err)
+	}
+	bad := []TransformConfig{
+		{CropX: 0.5, CropWidth: 0.6, CropHeight: 0.5},
+		{CropWidth: 0.5},
+		{AspectRatio: "wide"},
+		{AspectRatio: "16:0"},
+		{Rotate: 45},
+		{MaxDimension: -1},
+	}
+	for _, tr := range bad {
+		if err := tr.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", tr)
+		}
+	}
+}
+
+func TestDuplicatePolicyValidation(t *testing.T) {
+	for _, d := range []DuplicatePolicy{{}, DefaultDuplicatePolicy(), {Action: "skip", Threshold: 0}, {Action: "hold", Threshold: 64, Recent: 5}} {
+		if err := d.Validate(); err != nil {
+			t.Errorf("%#v should be valid: %s", d, err)
+		}
+	}
+	for _, d := range []DuplicatePolicy{{Action: "delete"}, {Threshold: 65}, {Threshold: -1}, {Recent: -1}} {
+		if err := d.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", d)
+		}
+	}
+	if r := (DuplicatePolicy{Action: "skip"}).WithDefaults().Recent; r != 20 {
+		t.Errorf("expected default of 20 recent images, got %d", r)
+	}
+}
+
+func TestCollagePolicyValidation(t *testing.T) {
+	for _, c := range []CollagePolicy{{}, DefaultCollagePolicy(), {Mode: "before", MinImages: 2, Columns: 6, Captions: true}, {Mode: "instead"}} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%#v should be valid: %s", c, err)
+		}
+	}
+	for _, c := range []CollagePolicy{{Mode: "after"}, {MinImages: 1}, {MinImages: -1}, {Columns: -1}, {Columns: 51}, {CellSize: 5000}} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", c)
+		}
+	}
+	if c := (CollagePolicy{Mode: "before"}).WithDefaults(); c.MinImages != 10 || c.CellSize != 320 {
+		t.Errorf("defaults not applied, %#v", c)
+	}
+}
+
+func TestAlertConfigValidation(t *testing.T) {
+	if err := (AlertConfig{WebHookURL: "discord.com/api/webhooks/1/abc"}).Validate(); err == nil {
+		t.Error("bad alert webhook should not be allowed")
+	}
+	if err := (AlertConfig{Command: "/nonexistent/alert-command"}).Validate(); err == nil {
+		t.Error("missing alert command should not be allowed")
+	}
+	if err := (AlertConfig{MinInterval: -1}).Validate(); err == nil {
+		t.Error("negative interval should not be allowed")
+	}
+	if err := (AlertConfig{WebHookURL: "https://discord.com/api/webhooks/1/abc"}).Validate(); err != nil {
+		t.Errorf("valid alert config rejected: %s", err)
+	}
+}
+
+func TestValidWebhookURL(t *testing.T) {
+	valid := []string{"https://discord.com/api/webhooks/123/abc", "http://localhost:8000/hook", "http://127.0.0.1:8000/hook"}
+	invalid := []string{"", "discord.com/api/webhooks/123/abc", "http://discord.com/api/webhooks/123/abc", "ftp://example.com/"}
+	for _, u := range valid {
+		if !ValidWebhookURL(u) {
+			t.Errorf("%s should be valid", u)
+		}
+	}
+	for _, u := range invalid {
+		if ValidWebhookURL(u) {
+			t.Errorf("%s should not be valid", u)
+		}
+	}
+}
+
 func v1Config() string {
 	f, err := ioutil.TempFile("", "dautest-*")
 	if err != nil {
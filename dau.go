@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
@@ -11,11 +12,11 @@ import (
 	"strings"
 	"time"
 
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
-
+	"github.com/tardisx/discord-auto-upload/alert"
 	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
+	"github.com/tardisx/discord-auto-upload/httpclient"
+	"github.com/tardisx/discord-auto-upload/image"
 	daulog "github.com/tardisx/discord-auto-upload/log"
 	"github.com/tardisx/discord-auto-upload/upload"
 
@@ -31,6 +32,7 @@ type watch struct {
 	newLastCheck time.Time
 	config       config.Watcher
 	uploader     *upload.Uploader
+	alerter      *alert.Alerter
 }
 
 func main() {
@@ -43,12 +45,32 @@ func main() {
 	conf.Changed = configChanged
 	conf.LoadOrInit()
 
+	// configure the HTTP client before anything tries to use it
+	err := httpclient.Configure(conf.Config.HTTP)
+	if err != nil {
+		daulog.Errorf("Could not configure HTTP client, using defaults: %s", err)
+	}
+
 	// create the uploader
 	up := upload.NewUploader()
+	up.ApplyConfig(conf.Config)
+
+	// tell someone about failures, if configured to
+	alerter := alert.New()
+	alerter.Configure(conf.Config.Alerts)
+	alerter.WatchUploads(up)
+
+	// keep a record of finished uploads, though we can manage without one
+	hist, err := history.Open(conf.HistoryFilename())
+	if err != nil {
+		daulog.Errorf("Upload history will not be kept: %s", err)
+	} else {
+		up.SetHistory(hist)
+	}
 
 	// log.Print("Opening web browser")
 	// open.Start("http://localhost:9090")
-	web := web.WebService{Config: conf, Uploader: up}
+	web := web.WebService{Config: conf, Uploader: up, History: hist}
 	web.StartWebServer()
 
 	if conf.Config.OpenBrowserOnStart {
@@ -70,24 +92,32 @@ func main() {
 	// create the watchers, restart them if config changes
 	// blocks forever
 	go func() {
-		startWatchers(conf, up, configChanged)
+		startWatchers(conf, up, alerter, configChanged)
 	}()
 	mainloop(conf)
 
 }
 
-func startWatchers(config *config.ConfigService, up *upload.Uploader, configChange chan bool) {
+func startWatchers(config *config.ConfigService, up *upload.Uploader, alerter *alert.Alerter, configChange chan bool) {
 	for {
 		daulog.Debug("Creating watchers")
 		ctx, cancel := context.WithCancel(context.Background())
 		for _, c := range config.Config.Watchers {
 			daulog.Infof("Creating watcher for %s with interval %d", c.Path, config.Config.WatchInterval)
-			watcher := watch{uploader: up, lastCheck: time.Now(), newLastCheck: time.Now(), config: c}
+			watcher := watch{uploader: up, alerter: alerter, lastCheck: time.Now(), newLastCheck: time.Now(), config: c}
 			go watcher.Watch(config.Config.WatchInterval, ctx)
 		}
 		// wait for single that the config changed
 		<-configChange
 		cancel()
+
+		// the HTTP and upload settings may have changed too
+		err := httpclient.Configure(config.Config.HTTP)
+		if err != nil {
+			daulog.Errorf("Could not configure HTTP client, using previous settings: %s", err)
+		}
+		up.ApplyConfig(config.Config)
+		alerter.Configure(config.Config.Alerts)
 		daulog.Info("starting new watchers due to config change")
 	}
 
@@ -101,9 +131,7 @@ func (w *watch) Watch(interval int, ctx context.Context) {
 			return
 		default:
 			newFiles := w.ProcessNewFiles()
-			for _, f := range newFiles {
-				w.uploader.AddFile(f, w.config)
-			}
+			w.uploader.AddFiles(newFiles, w.config)
 			// upload them
 			w.uploader.Upload()
 			daulog.Debugf("sleeping for %ds before next check of %s", interval, w.config.Path)
@@ -139,10 +167,12 @@ func (w *watch) checkPath() bool {
 	src, err := os.Stat(w.config.Path)
 	if err != nil {
 		daulog.Errorf("Problem with path '%s': %s", w.config.Path, err)
+		w.alerter.MissingPath(w.config.Path, err)
 		return false
 	}
 	if !src.IsDir() {
 		daulog.Errorf("Problem with path '%s': is not a directory", w.config.Path)
+		w.alerter.MissingPath(w.config.Path, errors.New("is not a directory"))
 		return false
 	}
 	return true
@@ -154,9 +184,7 @@ func (w *watch) checkPath() bool {
 // to the passed in array of files
 func (w *watch) checkFile(path string, found *[]string, exclusions []string) error {
 
-	extension := strings.ToLower(filepath.Ext(path))
-
-	if !(extension == ".png" || extension == ".jpg" || extension == ".gif") {
+	if !image.Supported(path) {
 		return nil
 	}
 
@@ -0,0 +1,191 @@
+// Package history keeps a permanent record of finished uploads, in a
+// small database on disk.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var bucketName = []byte("uploads")
+
+// Entry is a single upload of a file to a single destination.
+type Entry struct {
+	ID             uint64    `json:"id"`
+	Filename       string    `json:"filename"`        // original file on disk
+	UploadFilename string    `json:"upload_filename"` // filename as seen on discord
+	Hash           string    `json:"hash"`            // SHA-256 of the original file
+	Watcher        string    `json:"watcher"`         // path of the watcher which found the file
+	Destination    string    `json:"destination"`
+	URL            string    `json:"url"` // url on the discord CDN
+	MessageID      string    `json:"message_id"`
+	Size           int64     `json:"size"` // bytes, as uploaded
+	Width          int       `json:"width"`
+	Height         int       `json:"height"`
+	State          string    `json:"state"`
+	StateReason    string    `json:"state_reason"`
+	DryRun         bool      `json:"dry_run"`
+	AddedAt        time.Time `json:"added_at"` // when the file was found
+	UploadedAt     time.Time `json:"uploaded_at"`
+}
+
+// Query selects entries from the history. Empty fields match everything.
+type Query struct {
+	Search      string // matched against filename, watcher, destination and url
+	Watcher     string
+	Destination string
+	State       string
+	From        time.Time // entries added at or after this time
+	To          time.Time // entries added before this time
+
+	Offset int
+	Limit  int // 0 for no limit
+}
+
+// Page is the result of a query, newest entries first.
+type Page struct {
+	Entries []Entry `json:"entries"`
+	Total   int     `json:"total"` // number of entries matching, ignoring offset and limit
+	Offset  int     `json:"offset"`
+	Limit   int     `json:"limit"`
+}
+
+// Store is the on-disk upload history.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens the history database, creating it if necessary.
+func Open(filename string) (*Store, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open history %s: %s", filename, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot initialise history %s: %s", filename, err)
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes the database.
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Add records a new entry, setting its ID.
+func (s *Store) Add(e *Entry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		e.ID = id
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(key(id), data)
+	})
+}
+
+// Query returns the entries matching q, newest first.
+func (s *Store) Query(q Query) (Page, error) {
+	page := Page{Entries: []Entry{}, Offset: q.Offset, Limit: q.Limit}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketName).Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			e := Entry{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("corrupt history entry %d: %s", binary.BigEndian.Uint64(k), err)
+			}
+			if !q.matches(e) {
+				continue
+			}
+			if page.Total >= q.Offset && (q.Limit == 0 || len(page.Entries) < q.Limit) {
+				page.Entries = append(page.Entries, e)
+			}
+			page.Total++
+		}
+		return nil
+	})
+	return page, err
+}
+
+func (q Query) matches(e Entry) bool {
+	if q.Watcher != "" && e.Watcher != q.Watcher {
+		return false
+	}
+	if q.Destination != "" && e.Destination != q.Destination {
+		return false
+	}
+	if q.State != "" && e.State != q.State {
+		return false
+	}
+	if !q.From.IsZero() && e.AddedAt.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !e.AddedAt.Before(q.To) {
+		return false
+	}
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		found := false
+		for _, field := range []string{e.Filename, e.UploadFilename, e.Watcher, e.Destination, e.URL, e.Hash} {
+			if strings.Contains(strings.ToLower(field), search) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the database key for an ID. Keys are big-endian so they sort
+// in the order they were added.
+func key(id uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, id)
+	return b
+}
+
+var csvHeader = []string{"id", "filename", "upload_filename", "hash", "watcher", "destination", "url", "message_id",
+	"size", "width", "height", "state", "state_reason", "dry_run", "added_at", "uploaded_at"}
+
+// WriteCSV writes entries as CSV, with a header row.
+func WriteCSV(w io.Writer, entries []Entry) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, e := range entries {
+		cw.Write([]string{
+			strconv.FormatUint(e.ID, 10), e.Filename, e.UploadFilename, e.Hash, e.Watcher, e.Destination, e.URL, e.MessageID,
+			strconv.FormatInt(e.Size, 10), strconv.Itoa(e.Width), strconv.Itoa(e.Height), e.State, e.StateReason,
+			strconv.FormatBool(e.DryRun), formatTime(e.AddedAt), formatTime(e.UploadedAt),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,91 @@
+package history
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempStore(t *testing.T) *Store {
+	dir, err := ioutil.TempDir("", "dautest-history-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	s, err := Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestQuery(t *testing.T) {
+	s := tempStore(t)
+	day := time.Date(2022, 11, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		e := Entry{
+			Filename:    "/screenshots/shot" + string(rune('a'+i)) + ".png",
+			Watcher:     "/screenshots",
+			Destination: "webhook 1",
+			State:       "Complete",
+			AddedAt:     day.AddDate(0, 0, i),
+		}
+		if i%2 == 1 {
+			e.Destination = "archive"
+		}
+		if err := s.Add(&e); err != nil {
+			t.Fatal(err)
+		}
+		if e.ID != uint64(i+1) {
+			t.Errorf("expected ID %d, got %d", i+1, e.ID)
+		}
+	}
+
+	page, err := s.Query(Query{Limit: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 10 || len(page.Entries) != 3 || page.Entries[0].ID != 10 {
+		t.Errorf("unexpected first page %#v", page)
+	}
+
+	page, _ = s.Query(Query{Offset: 9, Limit: 3})
+	if len(page.Entries) != 1 || page.Entries[0].ID != 1 {
+		t.Errorf("unexpected last page %#v", page)
+	}
+
+	page, _ = s.Query(Query{Destination: "archive"})
+	if page.Total != 5 {
+		t.Errorf("expected 5 archive entries, got %d", page.Total)
+	}
+
+	page, _ = s.Query(Query{Search: "SHOTC"})
+	if page.Total != 1 || page.Entries[0].Filename != "/screenshots/shotc.png" {
+		t.Errorf("unexpected search result %#v", page)
+	}
+
+	page, _ = s.Query(Query{From: day.AddDate(0, 0, 2), To: day.AddDate(0, 0, 4)})
+	if page.Total != 2 || page.Entries[0].ID != 4 {
+		t.Errorf("unexpected date range result %#v", page)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := WriteCSV(buf, []Entry{{ID: 1, Filename: "a, b.png", State: "Complete", Width: 16, Height: 8}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "id,filename,") {
+		t.Fatalf("unexpected CSV %s", buf.String())
+	}
+	if !strings.HasPrefix(lines[1], `1,"a, b.png",`) {
+		t.Errorf("unexpected CSV row %s", lines[1])
+	}
+}
@@ -0,0 +1,113 @@
+// Package httpclient provides the HTTP client used for all outgoing
+// requests, configured with the user's proxy, TLS and timeout settings.
+package httpclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+var current *http.Client
+var lock sync.Mutex
+
+// Client returns the shared HTTP client. If Configure has not been called
+// a client with the default configuration is returned.
+func Client() *http.Client {
+	lock.Lock()
+	defer lock.Unlock()
+	if current == nil {
+		current, _ = New(config.DefaultHTTPConfig())
+	}
+	return current
+}
+
+// UploadClient returns a client sharing the connections and settings of
+// the shared client, but without its overall Timeout. Uploads may be rate
+// limited, so sending the body can take far longer than the timeout. They
+// are stopped by cancelling their context instead, and the timeout still
+// applies to waiting for discord's response once the body is sent.
+func UploadClient() *http.Client {
+	return &http.Client{Transport: Client().Transport}
+}
+
+// Configure replaces the shared HTTP client with one using the supplied
+// configuration. If the configuration is not usable the existing client is
+// kept and an error returned.
+func Configure(conf config.HTTPConfig) error {
+	c, err := New(conf)
+	if err != nil {
+		return err
+	}
+	lock.Lock()
+	current = c
+	lock.Unlock()
+	return nil
+}
+
+// New creates a new HTTP client with the supplied configuration.
+func New(conf config.HTTPConfig) (*http.Client, error) {
+	conf = conf.WithDefaults()
+
+	tlsVersion, err := conf.TLSVersion()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{MinVersion: tlsVersion}
+
+	if conf.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file %s: %s", conf.CAFile, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", conf.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if conf.ProxyURL != "" {
+		proxyURL, err := url.Parse(conf.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse proxy URL %s: %s", conf.ProxyURL, err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	connectTimeout := time.Duration(conf.ConnectTimeout) * time.Second
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: time.Duration(conf.KeepAlive) * time.Second,
+	}
+
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   connectTimeout,
+		DisableKeepAlives:     conf.KeepAlive < 0,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: time.Duration(conf.Timeout) * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(conf.Timeout) * time.Second,
+	}, nil
+}
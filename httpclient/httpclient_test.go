@@ -0,0 +1,98 @@
+package httpclient
+
+import (
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+func TestCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// without the CA, the server's certificate is not trusted
+	c, err := New(config.HTTPConfig{})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	if _, err := c.Get(server.URL); err == nil {
+		t.Error("request should have failed without the CA")
+	}
+
+	f, err := os.CreateTemp("", "dautest-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	f.Close()
+
+	c, err = New(config.HTTPConfig{CAFile: f.Name()})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	resp, err := c.Get(server.URL)
+	if err != nil {
+		t.Fatalf("request failed with the CA: %s", err)
+	}
+	resp.Body.Close()
+}
+
+func TestProxyAndTimeouts(t *testing.T) {
+	c, err := New(config.HTTPConfig{ProxyURL: "http://proxy.example.com:3128", Timeout: 120})
+	if err != nil {
+		t.Fatalf("could not create client: %s", err)
+	}
+	if c.Timeout.Seconds() != 120 {
+		t.Errorf("wrong timeout %s", c.Timeout)
+	}
+	if rht := c.Transport.(*http.Transport).ResponseHeaderTimeout; rht.Seconds() != 120 {
+		t.Errorf("wrong response header timeout %s", rht)
+	}
+	req, _ := http.NewRequest("GET", "https://discord.com/", nil)
+	proxy, err := c.Transport.(*http.Transport).Proxy(req)
+	if err != nil || proxy == nil || proxy.Host != "proxy.example.com:3128" {
+		t.Errorf("proxy not used: %v %v", proxy, err)
+	}
+}
+
+func TestBadCAFile(t *testing.T) {
+	f, err := os.CreateTemp("", "dautest-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write([]byte("not a certificate"))
+	f.Close()
+
+	if _, err := New(config.HTTPConfig{CAFile: f.Name()}); err == nil {
+		t.Error("should not accept a CA file with no certificates")
+	}
+	if err := Configure(config.HTTPConfig{CAFile: f.Name()}); err == nil {
+		t.Error("should not configure with a bad CA file")
+	}
+	if Client() == nil {
+		t.Error("should still have a client")
+	}
+}
+
+func TestUploadClient(t *testing.T) {
+	if err := Configure(config.HTTPConfig{Timeout: 5}); err != nil {
+		t.Fatal(err)
+	}
+	defer Configure(config.DefaultHTTPConfig())
+
+	c := UploadClient()
+	if c.Timeout != 0 {
+		t.Errorf("upload client should have no overall timeout, got %s", c.Timeout)
+	}
+	if c.Transport != Client().Transport {
+		t.Error("upload client should share the transport")
+	}
+}
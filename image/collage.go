@@ -0,0 +1,172 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	i "image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	"github.com/fogleman/gg"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font/inconsolata"
+)
+
+// DefaultCollageCellSize is the width of each image in a collage, if none
+// is set.
+const DefaultCollageCellSize = 320
+
+const (
+	collageGap           = 4  // pixels between and around the images
+	collageCaptionHeight = 20 // pixels of caption under each image
+)
+
+// collageBackground is the colour behind the images, the same as discord's
+// dark theme.
+var collageBackground = color.RGBA{0x36, 0x39, 0x3f, 0xff}
+
+// CollageOptions control how a contact sheet of images is laid out.
+type CollageOptions struct {
+	Columns  int  // images across, 0 to make the sheet roughly square
+	CellSize int  // width of each image in pixels, DefaultCollageCellSize if 0
+	Captions bool // write the name of each file under its image
+}
+
+// Collage draws a contact sheet of the images, as they will be uploaded:
+// with any markup, redactions and transform, but without a watermark. It is
+// written to a temporary JPEG file of no more than maxBytes, whose name is
+// returned. Images which cannot be read are left out.
+func Collage(stores []*Store, opts CollageOptions, maxBytes int64) (string, error) {
+	sheet, err := drawCollage(stores, opts)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, sheet, &jpeg.Options{Quality: maxJPEGQuality}); err != nil {
+		return "", fmt.Errorf("could not encode collage: %s", err)
+	}
+	data := buf.Bytes()
+	if maxBytes > 0 && int64(len(data)) > maxBytes {
+		daulog.Infof("collage is %d bytes, need to resize to fit in %d", len(data), maxBytes)
+		f := fitter{im: sheet, size: maxBytes}
+		data, err = f.fitJPEG(int64(len(data)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	out, err := os.CreateTemp("", "dau_collage_*.jpg")
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	if _, err := out.Write(data); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// collageImage decodes the image a store will upload, before it is
+// watermarked or resized.
+func (s *Store) collageImage() (i.Image, error) {
+	filename := s.OriginalFilename
+	if s.ModifiedFilename != "" {
+		filename = s.ModifiedFilename
+	}
+	im, _, _, err := decodeFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return s.Transform.apply(s.redactImage(im)), nil
+}
+
+// drawCollage lays the images out in a grid. Every cell has the shape of
+// the first image, other images are shrunk to fit inside their cell.
+func drawCollage(stores []*Store, opts CollageOptions) (i.Image, error) {
+	cellW := opts.CellSize
+	if cellW <= 0 {
+		cellW = DefaultCollageCellSize
+	}
+
+	// decode them all first, shrinking each straight away so only one full
+	// size image is held at a time
+	images := []i.Image{}
+	names := []string{}
+	cellH := 0
+	for _, s := range stores {
+		im, err := s.collageImage()
+		if err != nil {
+			daulog.Errorf("leaving %s out of the collage: %s", s.OriginalFilename, err)
+			continue
+		}
+		b := im.Bounds()
+		if cellH == 0 {
+			cellH = int(math.Round(float64(cellW) * float64(b.Dy()) / float64(b.Dx())))
+			cellH = maxInt(cellW/4, minInt(cellH, cellW*2))
+		}
+		scale := math.Min(1, math.Min(float64(cellW)/float64(b.Dx()), float64(cellH)/float64(b.Dy())))
+		w := maxInt(1, int(math.Round(float64(b.Dx())*scale)))
+		h := maxInt(1, int(math.Round(float64(b.Dy())*scale)))
+		small := i.NewRGBA(i.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(small, small.Rect, im, b, draw.Src, nil)
+		images = append(images, small)
+		names = append(names, filepath.Base(s.OriginalFilename))
+	}
+	if len(images) == 0 {
+		return nil, errors.New("none of the images could be read")
+	}
+
+	columns := opts.Columns
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(images)))))
+	}
+	columns = minInt(columns, len(images))
+	rows := (len(images) + columns - 1) / columns
+
+	rowH := cellH
+	if opts.Captions {
+		rowH += collageCaptionHeight
+	}
+	dc := gg.NewContext(collageGap+columns*(cellW+collageGap), collageGap+rows*(rowH+collageGap))
+	dc.SetColor(collageBackground)
+	dc.Clear()
+	dc.SetFontFace(inconsolata.Regular8x16)
+	dc.SetColor(color.White)
+
+	for n, im := range images {
+		x := collageGap + (n%columns)*(cellW+collageGap)
+		y := collageGap + (n/columns)*(rowH+collageGap)
+		b := im.Bounds()
+		dc.DrawImage(im, x+(cellW-b.Dx())/2, y+(cellH-b.Dy())/2)
+		if opts.Captions {
+			caption := fitCaption(dc, names[n], float64(cellW))
+			dc.DrawStringAnchored(caption, float64(x)+float64(cellW)/2, float64(y+cellH)+float64(collageCaptionHeight)/2, 0.5, 0.35)
+		}
+	}
+	return dc.Image(), nil
+}
+
+// fitCaption shortens the caption to fit in the width, keeping the end of
+// the name as that is where screenshot names usually differ.
+func fitCaption(dc *gg.Context, caption string, width float64) string {
+	if w, _ := dc.MeasureString(caption); w <= width {
+		return caption
+	}
+	runes := []rune(caption)
+	for len(runes) > 0 {
+		runes = runes[1:]
+		shortened := "..." + string(runes)
+		if w, _ := dc.MeasureString(shortened); w <= width {
+			return shortened
+		}
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package image
+
+import (
+	i "image"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// tempWhite writes a white PNG, returning its name.
+func tempWhite(t *testing.T, width, height int) string {
+	f, err := os.CreateTemp("", "dautest-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	png.Encode(f, white(width, height))
+	return f.Name()
+}
+
+func TestCollageLayout(t *testing.T) {
+	stores := []*Store{}
+	for n := 0; n < 5; n++ {
+		f := tempWhite(t, 160, 90)
+		defer os.Remove(f)
+		stores = append(stores, &Store{OriginalFilename: f})
+	}
+
+	// 5 images make a 3x2 grid of 160x90 cells
+	im, err := drawCollage(stores, CollageOptions{CellSize: 160})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := im.Bounds(); b.Dx() != 4+3*164 || b.Dy() != 4+2*94 {
+		t.Errorf("wrong collage size %v", b)
+	}
+	if r, _, _, _ := im.At(4+164+80, 4+45).RGBA(); r != 0xffff {
+		t.Error("second image is missing")
+	}
+	// the last cell is empty
+	if r, _, _, _ := im.At(4+2*164+80, 4+94+45).RGBA(); r == 0xffff {
+		t.Error("sixth cell should be empty")
+	}
+
+	// captions add to the height of each row
+	im, err = drawCollage(stores, CollageOptions{CellSize: 160, Columns: 5, Captions: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := im.Bounds(); b.Dx() != 4+5*164 || b.Dy() != 4+94+collageCaptionHeight {
+		t.Errorf("wrong collage size with captions %v", b)
+	}
+}
+
+func TestCollageRedacted(t *testing.T) {
+	f := tempWhite(t, 100, 100)
+	defer os.Remove(f)
+	stores := []*Store{
+		{OriginalFilename: f, Redactions: []Redaction{{X: 0, Y: 0, Width: 100, Height: 100, Mode: RedactFill}}},
+		{OriginalFilename: "/does/not/exist.png"},
+	}
+	im, err := drawCollage(stores, CollageOptions{CellSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := im.Bounds(); b.Dx() != 108 {
+		t.Errorf("unreadable image should be left out, %v", b)
+	}
+	if r, g, b, _ := im.At(50, 50).RGBA(); r+g+b != 0 {
+		t.Error("redaction not shown on the collage")
+	}
+
+	if _, err := drawCollage(stores[1:], CollageOptions{}); err == nil {
+		t.Error("collage of no readable images should be an error")
+	}
+}
+
+func TestCollageFits(t *testing.T) {
+	stores := []*Store{}
+	for n := 0; n < 4; n++ {
+		f := tempNoise(t, 400, 300, "png", 0)
+		defer os.Remove(f)
+		stores = append(stores, &Store{OriginalFilename: f})
+	}
+	filename, err := Collage(stores, CollageOptions{CellSize: 400, Captions: true}, 100_000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filename)
+	if size := fileSize(t, filename); size > 100_000 {
+		t.Errorf("collage is %d bytes, more than the limit", size)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, format, err := i.DecodeConfig(f); err != nil || format != "jpeg" {
+		t.Errorf("collage should be a jpeg, got %s %v", format, err)
+	}
+
+	s := Store{OriginalFilename: filename, Generated: true}
+	s.Cleanup()
+	if _, err := os.Stat(filename); err != nil {
+		t.Error("cleanup should keep the collage for thumbnails")
+	}
+	s.Discard()
+	if _, err := os.Stat(filename); err == nil {
+		t.Error("collage was not removed")
+	}
+}
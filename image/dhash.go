@@ -0,0 +1,43 @@
+package image
+
+import (
+	i "image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// DHash returns a perceptual "difference hash" of an image file. Images
+// which look the same have hashes which differ in only a few bits, even if
+// they were compressed differently or changed slightly, see HashDistance.
+func DHash(filename string) (uint64, error) {
+	im, _, _, err := decodeFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return dhash(im), nil
+}
+
+// dhash shrinks the image to 9x8 shades of grey, and sets a bit for each
+// pixel which is brighter than the one to its right.
+func dhash(im i.Image) uint64 {
+	small := i.NewGray(i.Rect(0, 0, 9, 8))
+	draw.BiLinear.Scale(small, small.Rect, im, im.Bounds(), draw.Src, nil)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HashDistance returns how many bits of two hashes differ, from 0 for
+// images which look the same to 64.
+func HashDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"os"
+	"testing"
+)
+
+// gradient returns an image getting lighter from left to right, or from
+// right to left if reversed.
+func gradient(width, height int, reversed bool) i.Image {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			v := uint8(x * 255 / width)
+			if reversed {
+				v = 255 - v
+			}
+			im.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return im
+}
+
+func TestDHash(t *testing.T) {
+	a := gradient(400, 300, false)
+	if h := dhash(a); h != 0 {
+		t.Errorf("brightening image should have no bits set, got %x", h)
+	}
+	if d := HashDistance(dhash(a), dhash(gradient(400, 300, true))); d != 64 {
+		t.Errorf("opposite images should be 64 bits apart, got %d", d)
+	}
+
+	// small changes, and scaling, make little difference
+	b := gradient(800, 600, false).(*i.RGBA)
+	for x := 0; x < 40; x++ {
+		b.Set(x+100, 100, color.White)
+	}
+	if d := HashDistance(dhash(a), dhash(b)); d > 2 {
+		t.Errorf("similar images are %d bits apart", d)
+	}
+}
+
+func TestDHashFile(t *testing.T) {
+	png := tempNoise(t, 200, 100, "png", 0)
+	defer os.Remove(png)
+	if _, err := DHash(png); err != nil {
+		t.Error(err)
+	}
+	if _, err := DHash("/does/not/exist.png"); err == nil {
+		t.Error("missing file should be an error")
+	}
+}
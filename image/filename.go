@@ -0,0 +1,75 @@
+package image
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SpoilerPrefix is the filename prefix which makes discord hide an
+// attachment until it is clicked.
+const SpoilerPrefix = "SPOILER_"
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// UploadFilename provides a name to be assigned to the upload on Discord
+func (s Store) UploadFilename() string {
+	name := "image"
+	if s.FilenameTemplate != "" {
+		name = s.expandFilenameTemplate()
+	}
+	if s.Spoiler {
+		name = SpoilerPrefix + name
+	}
+	return name + "." + s.OriginalFormat
+}
+
+// expandFilenameTemplate fills in the placeholders in the FilenameTemplate,
+// see expandTemplate.
+func (s Store) expandFilenameTemplate() string {
+	name := s.expandTemplate(s.FilenameTemplate)
+
+	// whatever the template, it must not try to specify a path
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// expandTemplate fills in the placeholders in a template:
+//
+//	{name}      the original filename, without the extension
+//	{safename}  the original filename, with anything but letters, numbers,
+//	            dots, dashes and underscores replaced
+//	{date}      the date the file was created, like 2022-11-01
+//	{time}      the time the file was created, like 13-45-01
+func (s Store) expandTemplate(template string) string {
+	base := filepath.Base(s.OriginalFilename)
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+
+	created := time.Now()
+	if fi, err := os.Stat(s.OriginalFilename); err == nil {
+		created = fi.ModTime()
+	}
+
+	r := strings.NewReplacer(
+		"{name}", base,
+		"{safename}", sanitiseFilename(base),
+		"{date}", created.Format("2006-01-02"),
+		"{time}", created.Format("15-04-05"),
+	)
+	return r.Replace(template)
+}
+
+func sanitiseFilename(name string) string {
+	name = unsafeFilenameChars.ReplaceAllString(name, "_")
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
@@ -0,0 +1,45 @@
+package image
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUploadFilename(t *testing.T) {
+	f, err := os.CreateTemp("", "dau test shot *.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	when := time.Date(2022, 11, 1, 13, 45, 1, 0, time.Local)
+	os.Chtimes(f.Name(), when, when)
+
+	s := Store{OriginalFilename: f.Name(), OriginalFormat: "png"}
+	if s.UploadFilename() != "image.png" {
+		t.Errorf("wrong default filename %s", s.UploadFilename())
+	}
+
+	s.Spoiler = true
+	if s.UploadFilename() != "SPOILER_image.png" {
+		t.Errorf("wrong spoiler filename %s", s.UploadFilename())
+	}
+
+	s.Spoiler = false
+	s.FilenameTemplate = "{safename}"
+	if got := s.UploadFilename(); got[:14] != "dau_test_shot_" {
+		t.Errorf("wrong sanitised filename %s", got)
+	}
+
+	s.FilenameTemplate = "shot {date} {time}"
+	if got := s.UploadFilename(); got != "shot 2022-11-01 13-45-01.png" {
+		t.Errorf("wrong templated filename %s", got)
+	}
+
+	s.FilenameTemplate = "../../{date}"
+	if got := s.UploadFilename(); got != ".._.._2022-11-01.png" {
+		t.Errorf("path not removed from filename %s", got)
+	}
+}
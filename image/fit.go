@@ -0,0 +1,250 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	i "image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// JPEG qualities we will pick from when fitting an image, the best
+	// which fits is used
+	minJPEGQuality = 60
+	maxJPEGQuality = 92
+
+	// maxFitAttempts is how many different scales we will try
+	maxFitAttempts = 10
+	// scaleTolerance is how close to the largest scale which fits we need
+	// to get before we stop looking
+	scaleTolerance = 0.02
+)
+
+// fitToSize makes sure the file to be uploaded is no more than size bytes,
+// shrinking it if needed. The check is made after watermarking, and when
+// the image has to shrink the watermark is drawn again on the smaller image
+// so it stays legible.
+func (s *Store) fitToSize(size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	fi, err := os.Stat(s.uploadSourceFilename())
+	if err != nil {
+		return err
+	}
+	currentSize := fi.Size()
+	if currentSize <= size {
+		return nil // nothing needs to be done
+	}
+
+	// start again from the image before it was watermarked
+	if s.WatermarkedFilename != "" {
+		os.Remove(s.WatermarkedFilename)
+		s.WatermarkedFilename = ""
+	}
+	source := s.uploadSourceFilename()
+	daulog.Infof("%s is %d bytes, need to resize to fit in %d", source, currentSize, size)
+
+	var wm *watermark
+	if s.Watermark {
+		wm, err = s.watermark()
+		if err != nil {
+			return err
+		}
+		defer wm.close()
+	}
+
+	var resized string
+	if s.OriginalFormat == "gif" {
+		// animations need every frame resized
+		resized, err = resizeGIFToUnder(source, currentSize, size, wm)
+	} else {
+		resized, err = s.fitStill(source, currentSize, size, wm)
+	}
+	if err != nil {
+		return err
+	}
+	s.ResizedFilename = resized
+	return nil
+}
+
+// fitStill fits a PNG or JPEG into size bytes, returning the name of the
+// new file. JPEGs have their quality lowered before they are scaled down.
+// Opaque PNGs are converted to JPEG instead of being scaled, if the store
+// allows it.
+func (s *Store) fitStill(filename string, currentSize, size int64, wm *watermark) (string, error) {
+	im, _, _, err := decodeFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	format := s.OriginalFormat
+	if format == "png" && s.ConvertPNGToJPEG && opaque(im) {
+		daulog.Infof("converting %s to jpeg to make it smaller", filename)
+		format = "jpeg"
+	}
+
+	f := fitter{im: im, watermark: wm, size: size}
+	var data []byte
+	switch format {
+	case "jpeg":
+		data, err = f.fitJPEG(currentSize)
+	case "png":
+		data, err = f.fitPNG(currentSize)
+	default:
+		err = fmt.Errorf("cannot resize format %s", format)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	resizedFile, err := os.CreateTemp("", "dau_resize_file_*")
+	if err != nil {
+		return "", err
+	}
+	defer resizedFile.Close()
+	_, err = resizedFile.Write(data)
+	if err != nil {
+		os.Remove(resizedFile.Name())
+		return "", err
+	}
+	s.OriginalFormat = format
+	daulog.Infof("File resized, now %d", len(data))
+	return resizedFile.Name(), nil
+}
+
+// fitter searches for the largest, best quality, encoding of an image
+// which is no more than size bytes.
+type fitter struct {
+	im        i.Image
+	watermark *watermark // nil for none
+	size      int64
+}
+
+// encode scales the image, watermarks it if needed and encodes it as a
+// JPEG of the given quality, or as a PNG if the quality is 0.
+func (f *fitter) encode(scale float64, quality int) ([]byte, error) {
+	var im i.Image = f.im
+	if scale < 1 {
+		b := f.im.Bounds()
+		w := int(math.Max(1, math.Round(float64(b.Dx())*scale)))
+		h := int(math.Max(1, math.Round(float64(b.Dy())*scale)))
+		dst := i.NewRGBA(i.Rect(0, 0, w, h))
+		draw.CatmullRom.Scale(dst, dst.Rect, f.im, b, draw.Src, nil)
+		im = dst
+	}
+	if f.watermark != nil {
+		im = f.watermark.draw(im)
+	}
+
+	buf := bytes.Buffer{}
+	var err error
+	if quality == 0 {
+		enc := png.Encoder{CompressionLevel: png.BestCompression}
+		err = enc.Encode(&buf, im)
+	} else {
+		err = jpeg.Encode(&buf, im, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode image: %s", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *fitter) fits(data []byte) bool {
+	return int64(len(data)) <= f.size
+}
+
+// fitJPEG tries lowering the quality at full size first, then scales the
+// image down and picks the best quality at that size.
+func (f *fitter) fitJPEG(currentSize int64) ([]byte, error) {
+	data, err := f.searchQuality(1, minJPEGQuality, maxJPEGQuality)
+	if err != nil || data != nil {
+		return data, err
+	}
+
+	data, scale, err := f.searchScale(currentSize, func(scale float64) ([]byte, error) {
+		return f.encode(scale, minJPEGQuality)
+	})
+	if err != nil {
+		return nil, err
+	}
+	better, err := f.searchQuality(scale, minJPEGQuality+1, maxJPEGQuality)
+	if err != nil {
+		return nil, err
+	}
+	if better != nil {
+		return better, nil
+	}
+	return data, nil
+}
+
+func (f *fitter) fitPNG(currentSize int64) ([]byte, error) {
+	data, _, err := f.searchScale(currentSize, func(scale float64) ([]byte, error) {
+		return f.encode(scale, 0)
+	})
+	return data, err
+}
+
+// searchQuality returns the best quality JPEG between the qualities lo and
+// hi which fits at the given scale, or nil if none of them do.
+func (f *fitter) searchQuality(scale float64, lo, hi int) ([]byte, error) {
+	var best []byte
+	for lo <= hi {
+		q := (lo + hi + 1) / 2
+		data, err := f.encode(scale, q)
+		if err != nil {
+			return nil, err
+		}
+		daulog.Debugf("scale %.3f quality %d is %d bytes", scale, q, len(data))
+		if f.fits(data) {
+			best = data
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+	return best, nil
+}
+
+// searchScale finds, to within scaleTolerance, the largest scale at which
+// the encoded image fits. The first guess assumes the size is proportional
+// to the area of the image, later guesses bisect between the largest scale
+// which fitted and the smallest which did not.
+func (f *fitter) searchScale(currentSize int64, encode func(scale float64) ([]byte, error)) ([]byte, float64, error) {
+	var best []byte
+	lo, hi := 0.0, 1.0 // lo fits, hi does not
+	scale, lastSize := 1.0, currentSize
+	for attempt := 1; attempt <= maxFitAttempts; attempt++ {
+		if best == nil {
+			scale = scale * 0.95 * math.Sqrt(float64(f.size)/float64(lastSize))
+		} else {
+			if hi-lo < scaleTolerance {
+				break
+			}
+			scale = (lo + hi) / 2
+		}
+
+		data, err := encode(scale)
+		if err != nil {
+			return nil, 0, err
+		}
+		daulog.Debugf("scale %.3f is %d bytes", scale, len(data))
+		if f.fits(data) {
+			best, lo = data, scale
+		} else {
+			hi, lastSize = scale, int64(len(data))
+		}
+	}
+	if best == nil {
+		return nil, 0, fmt.Errorf("failed to resize: was %d, needed %d", currentSize, f.size)
+	}
+	return best, lo, nil
+}
@@ -0,0 +1,150 @@
+package image
+
+import (
+	i "image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// tempNoise writes an image of random noise, which compresses badly, in the
+// given format, returning its filename.
+func tempNoise(t *testing.T, width, height int, format string, quality int) string {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	rand.Read(im.Pix)
+	for p := 3; p < len(im.Pix); p += 4 {
+		im.Pix[p] = 255
+	}
+
+	f, err := os.CreateTemp("", "dautest-*."+format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if format == "png" {
+		err = png.Encode(f, im)
+	} else {
+		err = jpeg.Encode(f, im, &jpeg.Options{Quality: quality})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func fileSize(t *testing.T, filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
+
+func TestFitPNG(t *testing.T) {
+	f := tempNoise(t, 600, 400, "png", 0)
+	defer os.Remove(f)
+	original := fileSize(t, f)
+
+	max := original / 3
+	s := Store{OriginalFilename: f, MaxBytes: int(max)}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	if size := fileSize(t, s.uploadSourceFilename()); size > max {
+		t.Errorf("resized png is %d bytes, more than %d", size, max)
+	}
+	if s.OriginalFormat != "png" {
+		t.Errorf("format changed to %s", s.OriginalFormat)
+	}
+	// noise is about the same size per pixel at any scale, so we should
+	// have kept close to a third of the area
+	w, _, _ := Dimensions(s.uploadSourceFilename())
+	if w < int(600*math.Sqrt(1.0/3)*0.85) || w >= 600 {
+		t.Errorf("resized to width %d, expected about %d", w, int(600*math.Sqrt(1.0/3)))
+	}
+}
+
+func TestFitJPEGQuality(t *testing.T) {
+	f := tempNoise(t, 300, 200, "jpeg", 100)
+	defer os.Remove(f)
+
+	// a lower quality is enough, the image should not be scaled
+	max := fileSize(t, f) * 2 / 3
+	s := Store{OriginalFilename: f, MaxBytes: int(max)}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	if size := fileSize(t, s.uploadSourceFilename()); size > max {
+		t.Errorf("resized jpeg is %d bytes, more than %d", size, max)
+	}
+	w, h, _ := Dimensions(s.uploadSourceFilename())
+	if w != 300 || h != 200 {
+		t.Errorf("jpeg was scaled to %dx%d", w, h)
+	}
+}
+
+func TestFitConvertsPNG(t *testing.T) {
+	f := tempNoise(t, 300, 200, "png", 0)
+	defer os.Remove(f)
+
+	max := fileSize(t, f) / 3
+	s := Store{OriginalFilename: f, MaxBytes: int(max), ConvertPNGToJPEG: true}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	if s.OriginalFormat != "jpeg" || s.UploadFilename() != "image.jpeg" {
+		t.Errorf("expected conversion to jpeg, got %s", s.UploadFilename())
+	}
+	if size := fileSize(t, s.uploadSourceFilename()); size > max {
+		t.Errorf("converted png is %d bytes, more than %d", size, max)
+	}
+	w, h, _ := Dimensions(s.uploadSourceFilename())
+	if w != 300 || h != 200 {
+		t.Errorf("converted png was scaled to %dx%d", w, h)
+	}
+}
+
+func TestFitAfterWatermark(t *testing.T) {
+	// re-encoding a low quality jpeg for the watermark makes it bigger
+	f := tempNoise(t, 400, 300, "jpeg", 40)
+	defer os.Remove(f)
+
+	max := fileSize(t, f) + 100
+	s := Store{OriginalFilename: f, MaxBytes: int(max), Watermark: true}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	if s.ResizedFilename == "" || s.WatermarkedFilename != "" {
+		t.Fatalf("expected the watermarked image to be resized")
+	}
+	if size := fileSize(t, s.uploadSourceFilename()); size > max {
+		t.Errorf("watermarked jpeg is %d bytes, more than %d", size, max)
+	}
+
+	// the watermark is drawn on the final image
+	in, _ := os.Open(s.uploadSourceFilename())
+	defer in.Close()
+	im, _, err := i.Decode(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := 310
+	if x >= im.Bounds().Dx() {
+		x = im.Bounds().Dx() - 1
+	}
+	r, g, b, _ := im.At(x, im.Bounds().Dy()-1).RGBA()
+	if r+g+b > 0x3000 {
+		t.Errorf("final image is not watermarked")
+	}
+}
@@ -0,0 +1,120 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	i "image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	// decoders for every format we accept
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// supportedExtensions are the file extensions of the images we can upload.
+var supportedExtensions = map[string]bool{
+	".png":  true,
+	".jpg":  true,
+	".jpeg": true,
+	".gif":  true,
+	".webp": true,
+	".bmp":  true,
+	".tif":  true,
+	".tiff": true,
+}
+
+// Supported returns true if the file looks like an image we can upload,
+// going by its extension.
+func Supported(filename string) bool {
+	return supportedExtensions[strings.ToLower(filepath.Ext(filename))]
+}
+
+// outputFormat decides which format an image should be uploaded as. Discord
+// previews PNG, JPEG and GIF well, anything else is converted: to PNG if it
+// has transparency or is usually lossless, otherwise to JPEG.
+func outputFormat(format string, im i.Image) string {
+	switch format {
+	case "png", "jpeg", "gif":
+		return format
+	case "webp":
+		if opaque(im) {
+			return "jpeg"
+		}
+	}
+	return "png"
+}
+
+// opaque returns true if the image has no transparent pixels.
+func opaque(im i.Image) bool {
+	if o, ok := im.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := im.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// convert writes the image in the output format, if it is not already in
+// that format or had to be turned the right way up. A JPEG which was turned
+// keeps its metadata, for stripMetadata to deal with according to the
+// policy, with the orientation reset.
+func (s *Store) convert(im i.Image, rotated bool) error {
+	if s.SourceFormat == s.OriginalFormat && !rotated {
+		return nil
+	}
+	if rotated {
+		daulog.Infof("rotating %s to match its orientation", s.uploadSourceFilename())
+	} else {
+		daulog.Infof("converting %s from %s to %s", s.uploadSourceFilename(), s.SourceFormat, s.OriginalFormat)
+	}
+
+	buf := bytes.Buffer{}
+	var err error
+	if s.OriginalFormat == "png" {
+		err = png.Encode(&buf, im)
+	} else {
+		err = jpeg.Encode(&buf, im, &jpeg.Options{Quality: 90})
+	}
+	if err != nil {
+		return fmt.Errorf("could not convert to %s: %s", s.OriginalFormat, err)
+	}
+	data := buf.Bytes()
+
+	if rotated && s.SourceFormat == "jpeg" && s.OriginalFormat == "jpeg" && s.Metadata != MetadataStrip {
+		original, err := os.ReadFile(s.uploadSourceFilename())
+		if err != nil {
+			return fmt.Errorf("could not read file: %s", err)
+		}
+		withMetadata, err := copyJPEGMetadata(original, data)
+		if err != nil {
+			daulog.Errorf("could not keep the metadata of %s: %s", s.uploadSourceFilename(), err)
+		} else {
+			data = withMetadata
+		}
+	}
+
+	converted, err := os.CreateTemp("", "dau_convert_file_*")
+	if err != nil {
+		return err
+	}
+	defer converted.Close()
+	if _, err := converted.Write(data); err != nil {
+		os.Remove(converted.Name())
+		return err
+	}
+	s.ConvertedFilename = converted.Name()
+	return nil
+}
@@ -0,0 +1,79 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"os"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func TestSupported(t *testing.T) {
+	for _, f := range []string{"a.png", "b.JPG", "c.jpeg", "d.gif", "e.webp", "f.bmp", "g.tif", "h.TIFF"} {
+		if !Supported(f) {
+			t.Errorf("%s should be supported", f)
+		}
+	}
+	for _, f := range []string{"a.txt", "b.png.part", "c"} {
+		if Supported(f) {
+			t.Errorf("%s should not be supported", f)
+		}
+	}
+}
+
+func TestConvertFormats(t *testing.T) {
+	opaqueImage := i.NewRGBA(i.Rect(0, 0, 32, 32))
+	for p := 3; p < len(opaqueImage.Pix); p += 4 {
+		opaqueImage.Pix[p] = 255
+	}
+	transparentImage := i.NewNRGBA(i.Rect(0, 0, 32, 32))
+	transparentImage.Set(1, 1, color.NRGBA{255, 0, 0, 255})
+
+	tests := []struct {
+		name   string
+		encode func(f *os.File) error
+		source string
+		output string
+	}{
+		{"bmp", func(f *os.File) error { return bmp.Encode(f, opaqueImage) }, "bmp", "png"},
+		{"tiff", func(f *os.File) error { return tiff.Encode(f, transparentImage, nil) }, "tiff", "png"},
+	}
+	for _, test := range tests {
+		f, err := os.CreateTemp("", "dautest-*."+test.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.encode(f)
+		f.Close()
+		defer os.Remove(f.Name())
+
+		s := Store{OriginalFilename: f.Name(), MaxBytes: 8_000_000}
+		if err := s.Prepare(); err != nil {
+			t.Fatalf("could not prepare %s: %s", test.name, err)
+		}
+		defer s.Cleanup()
+		if s.SourceFormat != test.source || s.OriginalFormat != test.output || s.UploadFilename() != "image."+test.output {
+			t.Errorf("%s: expected %s converted to %s, got %s to %s", test.name, test.source, test.output, s.SourceFormat, s.OriginalFormat)
+		}
+		if s.uploadSourceFilename() == f.Name() {
+			t.Errorf("%s: file was not converted", test.name)
+		}
+	}
+}
+
+func TestConvertWebP(t *testing.T) {
+	s := Store{OriginalFilename: "testdata/blue-purple-pink.lossy.webp", MaxBytes: 8_000_000}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare webp: %s", err)
+	}
+	defer s.Cleanup()
+	if s.SourceFormat != "webp" || s.OriginalFormat != "jpeg" {
+		t.Errorf("expected webp converted to jpeg, got %s to %s", s.SourceFormat, s.OriginalFormat)
+	}
+	w, h, err := Dimensions(s.uploadSourceFilename())
+	if err != nil || w == 0 || h == 0 {
+		t.Errorf("converted file is not an image: %s", err)
+	}
+}
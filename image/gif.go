@@ -0,0 +1,250 @@
+package image
+
+import (
+	"fmt"
+	i "image"
+	"image/color"
+	"image/gif"
+	"math"
+	"os"
+	"sort"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	"golang.org/x/image/draw"
+)
+
+// maxGIFAttempts is how many times we will try to shrink an animated GIF
+// before giving up.
+const maxGIFAttempts = 8
+
+// gifOptions control how a GIF is rewritten.
+type gifOptions struct {
+	scale     float64    // 1 keeps the original size
+	frameStep int        // keep every frameStep'th frame, 1 keeps them all
+	colours   int        // maximum colours in each frame's palette
+	watermark *watermark // nil for none
+
+	// edit, if not nil, changes each frame at full size, before it is
+	// scaled. It must not change the image it is given, and must return
+	// images of the same size for every frame.
+	edit func(i.Image) i.Image
+}
+
+// rewriteGIF decodes every frame of a GIF, applies the options and writes
+// the result to a new temporary file, returning its name. Frame delays,
+// disposal methods and the loop count are kept. Each output frame covers
+// the whole image, so scaling and watermarking work however the original
+// frames were laid out.
+func rewriteGIF(filename string, opts gifOptions) (string, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return "", fmt.Errorf("could not open file: %s", err)
+	}
+	g, err := gif.DecodeAll(in)
+	in.Close()
+	if err != nil {
+		return "", fmt.Errorf("could not decode gif: %s", err)
+	}
+
+	width, height := g.Config.Width, g.Config.Height
+	if width == 0 || height == 0 {
+		b := g.Image[0].Bounds()
+		width, height = b.Max.X, b.Max.Y
+	}
+	// the size of the output, once we know the size of the edited frames
+	newWidth, newHeight := 0, 0
+	step := opts.frameStep
+	if step < 1 {
+		step = 1
+	}
+
+	out := &gif.GIF{LoopCount: g.LoopCount}
+	canvas := i.NewRGBA(i.Rect(0, 0, width, height))
+	for idx, frame := range g.Image {
+		disposal := byte(0)
+		if idx < len(g.Disposal) {
+			disposal = g.Disposal[idx]
+		}
+
+		var previous *i.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = i.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		if idx%step == 0 {
+			// this frame stands in for the ones dropped after it
+			delay, clears := 0, false
+			for j := idx; j < idx+step && j < len(g.Image); j++ {
+				delay += g.Delay[j]
+				if j < len(g.Disposal) && (g.Disposal[j] == gif.DisposalBackground || g.Disposal[j] == gif.DisposalPrevious) {
+					clears = true
+				}
+			}
+			outDisposal := disposal
+			if clears {
+				// the frame covers everything, so restoring the previous
+				// frame is the same as clearing it
+				outDisposal = gif.DisposalBackground
+			}
+
+			var im i.Image = canvas
+			if opts.edit != nil {
+				im = opts.edit(canvas)
+			}
+			if newWidth == 0 {
+				newWidth = int(math.Max(1, math.Round(float64(im.Bounds().Dx())*opts.scale)))
+				newHeight = int(math.Max(1, math.Round(float64(im.Bounds().Dy())*opts.scale)))
+			}
+			if newWidth != im.Bounds().Dx() || newHeight != im.Bounds().Dy() {
+				scaled := i.NewRGBA(i.Rect(0, 0, newWidth, newHeight))
+				draw.CatmullRom.Scale(scaled, scaled.Rect, im, im.Bounds(), draw.Src, nil)
+				im = scaled
+			}
+			if opts.watermark != nil {
+				im = opts.watermark.draw(im)
+			}
+
+			out.Image = append(out.Image, paletted(im, opts.colours))
+			out.Delay = append(out.Delay, delay)
+			out.Disposal = append(out.Disposal, outDisposal)
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), i.Transparent, i.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	out.Config = i.Config{Width: newWidth, Height: newHeight}
+
+	outFile, err := os.CreateTemp("", "dau_gif_file_*")
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+	err = gif.EncodeAll(outFile, out)
+	if err != nil {
+		os.Remove(outFile.Name())
+		return "", fmt.Errorf("could not encode gif: %s", err)
+	}
+	return outFile.Name(), nil
+}
+
+// resizeGIFToUnder shrinks a GIF until it is no more than size bytes. The
+// frames are scaled down first, then if that is not enough frames are
+// dropped and the number of colours reduced. The watermark, if not nil, is
+// drawn after scaling.
+func resizeGIFToUnder(filename string, currentSize, size int64, wm *watermark) (string, error) {
+	frames, err := gifFrameCount(filename)
+	if err != nil {
+		return "", err
+	}
+
+	// the file size is roughly proportional to the number of pixels
+	opts := gifOptions{scale: 0.95 / math.Sqrt(float64(currentSize)/float64(size)), frameStep: 1, colours: 256, watermark: wm}
+	for attempt := 1; attempt <= maxGIFAttempts; attempt++ {
+		daulog.Infof("resizing gif: scale %.2f, keeping every %d of %d frames, %d colours", opts.scale, opts.frameStep, frames, opts.colours)
+		resized, err := rewriteGIF(filename, opts)
+		if err != nil {
+			return "", err
+		}
+		fi, err := os.Stat(resized)
+		if err != nil {
+			os.Remove(resized)
+			return "", err
+		}
+		if fi.Size() <= size {
+			daulog.Infof("gif resized, now %d", fi.Size())
+			return resized, nil
+		}
+		os.Remove(resized)
+
+		ratio := float64(fi.Size()) / float64(size)
+		if attempt >= 2 && frames/opts.frameStep >= 4 {
+			opts.frameStep *= 2
+			ratio = ratio / 2
+		}
+		if attempt >= 3 && opts.colours > 32 {
+			opts.colours /= 2
+		}
+		opts.scale = opts.scale * 0.95 / math.Sqrt(math.Max(ratio, 1))
+	}
+	return "", fmt.Errorf("failed to resize gif: was %d, needed %d", currentSize, size)
+}
+
+func gifFrameCount(filename string) (int, error) {
+	in, err := os.Open(filename)
+	if err != nil {
+		return 0, fmt.Errorf("could not open file: %s", err)
+	}
+	defer in.Close()
+	g, err := gif.DecodeAll(in)
+	if err != nil {
+		return 0, fmt.Errorf("could not decode gif: %s", err)
+	}
+	return len(g.Image), nil
+}
+
+// paletted converts an image to one with a palette of at most n colours,
+// chosen from the colours used most in the image. A transparent entry is
+// included if the image has any transparent pixels.
+func paletted(im i.Image, n int) *i.Paletted {
+	if n < 2 || n > 256 {
+		n = 256
+	}
+	b := im.Bounds()
+
+	// count colours, with 5 bits per channel so similar colours share
+	type bucket struct {
+		r, g, b, count int
+	}
+	buckets := map[uint16]*bucket{}
+	transparent := false
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if c.A < 128 {
+				transparent = true
+				continue
+			}
+			key := uint16(c.R>>3)<<10 | uint16(c.G>>3)<<5 | uint16(c.B>>3)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.count++
+		}
+	}
+
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, bk := range buckets {
+		sorted = append(sorted, bk)
+	}
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].count > sorted[b].count })
+
+	pal := color.Palette{}
+	if transparent {
+		pal = append(pal, color.NRGBA{})
+	}
+	for _, bk := range sorted {
+		if len(pal) >= n {
+			break
+		}
+		pal = append(pal, color.NRGBA{R: uint8(bk.r / bk.count), G: uint8(bk.g / bk.count), B: uint8(bk.b / bk.count), A: 255})
+	}
+	if len(pal) == 0 {
+		pal = append(pal, color.NRGBA{A: 255})
+	}
+
+	dst := i.NewPaletted(i.Rect(0, 0, b.Dx(), b.Dy()), pal)
+	draw.Draw(dst, dst.Rect, im, b.Min, draw.Src)
+	return dst
+}
@@ -0,0 +1,126 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// tempGIF writes an animated GIF, returning its filename. Each frame after
+// the first only covers part of the image, as many real animations do.
+func tempGIF(t *testing.T, width, height, frames int, noisy bool) string {
+	pal := color.Palette{color.Transparent}
+	for c := 0; c < 255; c++ {
+		pal = append(pal, color.RGBA{uint8(c), uint8(255 - c), uint8(c * 7), 255})
+	}
+	g := &gif.GIF{LoopCount: 3}
+	for n := 0; n < frames; n++ {
+		rect := i.Rect(0, 0, width, height)
+		if n > 0 {
+			rect = i.Rect(width/4, height/4, width/2, height/2)
+		}
+		frame := i.NewPaletted(rect, pal)
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(n + 1)
+			if noisy {
+				frame.Pix[p] = uint8(rand.Intn(255) + 1)
+			}
+		}
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10+n)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	g.Disposal[1] = gif.DisposalBackground
+
+	f, err := os.CreateTemp("", "dautest-*.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := gif.EncodeAll(f, g); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func decodeGIF(t *testing.T, filename string) *gif.GIF {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	g, err := gif.DecodeAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func TestWatermarkGIF(t *testing.T) {
+	f := tempGIF(t, 400, 100, 4, false)
+	defer os.Remove(f)
+
+	s := Store{OriginalFilename: f, MaxBytes: 8_000_000, Watermark: true}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare gif: %s", err)
+	}
+	defer s.Cleanup()
+	if s.OriginalFormat != "gif" || s.UploadFilename() != "image.gif" {
+		t.Errorf("unexpected format %s", s.OriginalFormat)
+	}
+
+	g := decodeGIF(t, s.uploadSourceFilename())
+	if len(g.Image) != 4 || g.LoopCount != 3 {
+		t.Fatalf("expected 4 frames looping 3 times, got %d frames looping %d", len(g.Image), g.LoopCount)
+	}
+	for n, d := range g.Delay {
+		if d != 10+n {
+			t.Errorf("frame %d delay changed to %d", n, d)
+		}
+	}
+	if g.Disposal[1] != gif.DisposalBackground {
+		t.Error("disposal method was not kept")
+	}
+	// the watermark background is black, at the bottom left of every frame
+	for n, frame := range g.Image {
+		if frame.Bounds() != i.Rect(0, 0, 400, 100) {
+			t.Errorf("frame %d has bounds %v", n, frame.Bounds())
+		}
+		r, gr, b, _ := frame.At(300, 99).RGBA()
+		if r+gr+b != 0 {
+			t.Errorf("frame %d is not watermarked", n)
+		}
+	}
+}
+
+func TestResizeGIF(t *testing.T) {
+	f := tempGIF(t, 400, 400, 8, true)
+	defer os.Remove(f)
+	fi, _ := os.Stat(f)
+
+	max := fi.Size() / 4
+	s := Store{OriginalFilename: f, MaxBytes: int(max)}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare gif: %s", err)
+	}
+	defer s.Cleanup()
+
+	fi, _ = os.Stat(s.uploadSourceFilename())
+	if fi.Size() > max {
+		t.Errorf("resized gif is %d bytes, more than %d", fi.Size(), max)
+	}
+	g := decodeGIF(t, s.uploadSourceFilename())
+	if g.Config.Width >= 400 || len(g.Image) == 0 {
+		t.Errorf("gif was not resized, %dx%d with %d frames", g.Config.Width, g.Config.Height, len(g.Image))
+	}
+	total := 0
+	for _, d := range g.Delay {
+		total += d
+	}
+	if total != 10+11+12+13+14+15+16+17 {
+		t.Errorf("animation length changed to %d", total)
+	}
+}
@@ -5,14 +5,11 @@ package image
 import (
 	"fmt"
 	i "image"
-	"image/jpeg"
 	"image/png"
 	"io"
 	"os"
 
 	daulog "github.com/tardisx/discord-auto-upload/log"
-
-	"golang.org/x/image/draw"
 )
 
 // the filenames below are ordered in a specific way
@@ -24,133 +21,151 @@ import (
 
 type Store struct {
 	OriginalFilename    string
-	OriginalFormat      string // jpeg, png
+	SourceFormat        string // format of the file we start from: jpeg, png, gif, webp, bmp or tiff
+	OriginalFormat      string // format the file is uploaded as: jpeg, png or gif
 	ModifiedFilename    string // if the user applied modifications
+	ConvertedFilename   string // if the file had to be converted to a different format
+	RedactedFilename    string // if parts of the image were hidden
+	TransformedFilename string // if the image was cropped, scaled, rotated or flipped
+	StrippedFilename    string // if metadata was removed
 	ResizedFilename     string // if the file had to be resized to be uploaded
 	WatermarkedFilename string
 	MaxBytes            int
 	Watermark           bool
-}
+	WatermarkOptions    WatermarkOptions
+	FilenameTemplate    string // see UploadFilename
+	Spoiler             bool
+	ConvertPNGToJPEG    bool        // opaque PNGs which are too big may be uploaded as JPEGs instead
+	Metadata            string      // one of the Metadata policies, MetadataSafe if empty
+	FixedRedactions     []Redaction // from the watcher, in fractions of the image size
+	Redactions          []Redaction // for this upload, in pixels
+	Transform           Transform
+	Generated           bool // OriginalFilename was made by dau, like a collage, and is removed by Discard
 
-// ReadCloser returns an io.ReadCloser providing the imagedata
-// with the manglings that have been requested
-func (s *Store) ReadCloser() (io.ReadCloser, error) {
-	// determine format
-	s.determineFormat()
+	prepared bool
+}
 
-	// check if we will fit the number of bytes, resize if necessary
-	err := s.resizeToUnder(int64(s.MaxBytes))
-	if err != nil {
-		return nil, err
+// Prepare applies the manglings that have been requested, producing the
+// file that will be uploaded. The work is only done once, the same file
+// is used for every upload until CleanupIntermediate is called.
+func (s *Store) Prepare() error {
+	if s.prepared {
+		return nil
 	}
 
-	// the conundrum here is that the watermarking could modify the file size again, maybe going over
-	//	the MaxBytes size. That would mostly be about jpeg compression levels I guess...
-	if s.Watermark {
-		s.applyWatermark()
-	}
+	// start from scratch, in case this is a retry
+	s.CleanupIntermediate()
 
-	// return the reader
-	f, err := os.Open(s.uploadSourceFilename())
+	// determine format, converting if discord will not preview it
+	err := s.determineFormat()
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return f, nil
-}
-
-func (s *Store) determineFormat() error {
-	file, err := os.Open(s.OriginalFilename)
+	err = s.applyRedactions()
 	if err != nil {
-		panic(fmt.Errorf("could not open file: %s", err))
+		return err
 	}
-	defer file.Close()
 
-	_, format, err := i.Decode(file)
+	err = s.applyTransform()
 	if err != nil {
-		panic(fmt.Errorf("could not decode file: %s", err))
+		return err
 	}
-	s.OriginalFormat = format
-	return nil
-}
 
-// resizeToUnder resizes the image, if necessary
-func (s *Store) resizeToUnder(size int64) error {
-	fileToResize := s.uploadSourceFilename()
-	fi, err := os.Stat(s.uploadSourceFilename())
+	err = s.stripMetadata()
 	if err != nil {
 		return err
 	}
-	currentSize := fi.Size()
-	if currentSize <= size {
-		return nil // nothing needs to be done
-	}
 
-	daulog.Infof("%s is %d bytes, need to resize to fit in %d", fileToResize, currentSize, size)
+	if s.Watermark {
+		err = s.applyWatermark()
+		if err != nil {
+			return err
+		}
+	}
 
-	file, err := os.Open(fileToResize)
+	// check the final file fits in the number of bytes, shrink if necessary
+	err = s.fitToSize(int64(s.MaxBytes))
 	if err != nil {
-		panic(fmt.Errorf("could not open file: %s", err))
+		return err
 	}
-	defer file.Close()
 
-	im, _, err := i.Decode(file)
+	s.prepared = true
+	return nil
+}
+
+// ReadCloser returns an io.ReadCloser providing the imagedata
+// with the manglings that have been requested
+func (s *Store) ReadCloser() (io.ReadCloser, error) {
+	err := s.Prepare()
 	if err != nil {
-		panic(fmt.Errorf("could not decode file: %s", err))
+		return nil, err
 	}
 
-	// if the size is 10% too big, we reduce X and Y by 10% - this is overkill but should
-	// get us across the line in most cases
-	fraction := float64(currentSize) / float64(size) // say 1.1 for 10%
-	newXY := i.Point{
-		X: int(float64(im.Bounds().Max.X) / fraction),
-		Y: int(float64(im.Bounds().Max.Y) / fraction),
+	// return the reader
+	f, err := os.Open(s.uploadSourceFilename())
+	if err != nil {
+		return nil, err
 	}
 
-	daulog.Infof("fraction is %f, will resize to %dx%d", fraction, newXY.X, newXY.Y)
+	return f, nil
+}
 
-	dst := i.NewRGBA(i.Rect(0, 0, newXY.X, newXY.Y))
-	draw.BiLinear.Scale(dst, dst.Rect, im, im.Bounds(), draw.Over, nil)
+// WriteOriginal writes the original image to w, for the editor to start
+// from. An image which has to be turned the right way up is written as a
+// PNG, otherwise the file is copied unchanged.
+func (s *Store) WriteOriginal(w io.Writer) error {
+	if fileOrientation(s.OriginalFilename) == orientationNormal {
+		f, err := os.Open(s.OriginalFilename)
+		if err != nil {
+			return fmt.Errorf("could not open file: %s", err)
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	}
 
-	resizedFile, err := os.CreateTemp("", "dau_resize_file_*")
+	im, _, _, err := decodeFile(s.OriginalFilename)
 	if err != nil {
 		return err
 	}
+	return png.Encode(w, im)
+}
 
-	if s.OriginalFormat == "png" {
-		err = png.Encode(resizedFile, dst)
-		if err != nil {
-			return err
-		}
-	} else if s.OriginalFormat == "jpeg" {
-		err = jpeg.Encode(resizedFile, dst, nil)
-		if err != nil {
-			return err
-		}
-
-	} else {
-		panic("unknown format " + s.OriginalFormat)
+// determineFormat finds the format of the file we are starting from, which
+// is the user's modified version if there is one, and the format it will
+// be uploaded as. If they differ the file is converted.
+func (s *Store) determineFormat() error {
+	im, format, rotated, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		return err
 	}
+	s.SourceFormat = format
+	s.OriginalFormat = outputFormat(format, im)
+	return s.convert(im, rotated)
+}
 
-	s.ResizedFilename = resizedFile.Name()
-	resizedFile.Close()
+// Dimensions returns the width and height of an image file, the right way
+// up, without decoding the whole image.
+func Dimensions(filename string) (int, int, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, fmt.Errorf("could not open file: %s", err)
+	}
+	defer file.Close()
 
-	fi, err = os.Stat(s.uploadSourceFilename())
+	conf, _, err := i.DecodeConfig(file)
 	if err != nil {
-		return err
+		return 0, 0, fmt.Errorf("could not decode file: %s", err)
 	}
-	newSize := fi.Size()
-	if newSize <= size {
-		daulog.Infof("File resized, now %d", newSize)
-		return nil // nothing needs to be done
-	} else {
-		return fmt.Errorf("failed to resize: was %d, now %d, needed %d", currentSize, newSize, size)
+	if fileOrientation(filename) >= orientationTranspose {
+		return conf.Height, conf.Width, nil
 	}
-
+	return conf.Width, conf.Height, nil
 }
 
-// uploadSourceFilename gives us the filename, which might be a watermarked, resized
-// or markedup version, depending on what has happened to this file.
+// uploadSourceFilename gives us the filename, which might be a watermarked, resized,
+// stripped, transformed, redacted, converted or markedup version, depending on what has happened to this file.
 func (s Store) uploadSourceFilename() string {
 	if s.WatermarkedFilename != "" {
 		return s.WatermarkedFilename
@@ -158,17 +173,24 @@ func (s Store) uploadSourceFilename() string {
 	if s.ResizedFilename != "" {
 		return s.ResizedFilename
 	}
+	if s.StrippedFilename != "" {
+		return s.StrippedFilename
+	}
+	if s.TransformedFilename != "" {
+		return s.TransformedFilename
+	}
+	if s.RedactedFilename != "" {
+		return s.RedactedFilename
+	}
+	if s.ConvertedFilename != "" {
+		return s.ConvertedFilename
+	}
 	if s.ModifiedFilename != "" {
 		return s.ModifiedFilename
 	}
 	return s.OriginalFilename
 }
 
-// UploadFilename provides a name to be assigned to the upload on Discord
-func (s Store) UploadFilename() string {
-	return "image." + s.OriginalFormat
-}
-
 // Cleanup removes all the temporary files that we might have created
 func (s Store) Cleanup() {
 	daulog.Infof("cleaning temporary files %#v", s)
@@ -177,6 +199,22 @@ func (s Store) Cleanup() {
 		daulog.Infof("removing %s", s.ModifiedFilename)
 		os.Remove(s.ModifiedFilename)
 	}
+	if s.ConvertedFilename != "" {
+		daulog.Infof("removing %s", s.ConvertedFilename)
+		os.Remove(s.ConvertedFilename)
+	}
+	if s.RedactedFilename != "" {
+		daulog.Infof("removing %s", s.RedactedFilename)
+		os.Remove(s.RedactedFilename)
+	}
+	if s.TransformedFilename != "" {
+		daulog.Infof("removing %s", s.TransformedFilename)
+		os.Remove(s.TransformedFilename)
+	}
+	if s.StrippedFilename != "" {
+		daulog.Infof("removing %s", s.StrippedFilename)
+		os.Remove(s.StrippedFilename)
+	}
 	if s.ResizedFilename != "" {
 		daulog.Infof("removing %s", s.ResizedFilename)
 		os.Remove(s.ResizedFilename)
@@ -186,3 +224,50 @@ func (s Store) Cleanup() {
 		os.Remove(s.WatermarkedFilename)
 	}
 }
+
+// Discard removes the original file if dau made it. It is called once the
+// upload is forgotten, as the file is still needed for thumbnails after the
+// upload has finished.
+func (s *Store) Discard() {
+	if s.Generated && s.OriginalFilename != "" {
+		daulog.Infof("removing %s", s.OriginalFilename)
+		os.Remove(s.OriginalFilename)
+	}
+}
+
+// CleanupIntermediate removes the temporary files created while preparing
+// the upload, but keeps any user modifications so the upload can be
+// attempted again.
+func (s *Store) CleanupIntermediate() {
+	s.prepared = false
+	if s.ConvertedFilename != "" {
+		daulog.Debugf("removing %s", s.ConvertedFilename)
+		os.Remove(s.ConvertedFilename)
+		s.ConvertedFilename = ""
+	}
+	if s.RedactedFilename != "" {
+		daulog.Debugf("removing %s", s.RedactedFilename)
+		os.Remove(s.RedactedFilename)
+		s.RedactedFilename = ""
+	}
+	if s.TransformedFilename != "" {
+		daulog.Debugf("removing %s", s.TransformedFilename)
+		os.Remove(s.TransformedFilename)
+		s.TransformedFilename = ""
+	}
+	if s.StrippedFilename != "" {
+		daulog.Debugf("removing %s", s.StrippedFilename)
+		os.Remove(s.StrippedFilename)
+		s.StrippedFilename = ""
+	}
+	if s.ResizedFilename != "" {
+		daulog.Debugf("removing %s", s.ResizedFilename)
+		os.Remove(s.ResizedFilename)
+		s.ResizedFilename = ""
+	}
+	if s.WatermarkedFilename != "" {
+		daulog.Debugf("removing %s", s.WatermarkedFilename)
+		os.Remove(s.WatermarkedFilename)
+		s.WatermarkedFilename = ""
+	}
+}
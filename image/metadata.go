@@ -0,0 +1,342 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// Metadata policies, which say what metadata is left in uploaded files.
+const (
+	MetadataSafe  = "safe"  // keep only the orientation and colour profile, the default
+	MetadataStrip = "strip" // remove all metadata
+	MetadataKeep  = "keep"  // leave files as they are, except the orientation of those turned the right way up
+)
+
+// more JPEG markers
+const (
+	jpegAPP0  = 0xe0
+	jpegAPP2  = 0xe2
+	jpegAPP14 = 0xee
+	jpegAPP15 = 0xef
+	jpegCOM   = 0xfe
+)
+
+var (
+	jfifHeader  = []byte("JFIF\x00")
+	iccHeader   = []byte("ICC_PROFILE\x00")
+	adobeHeader = []byte("Adobe")
+
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// pngKeepChunks are the ancillary PNG chunks which affect how the image
+// looks, or animates, rather than describing it. Critical chunks are always
+// kept.
+var pngKeepChunks = map[string]bool{
+	"tRNS": true, "gAMA": true, "cHRM": true, "sRGB": true, "sBIT": true,
+	"bKGD": true, "pHYs": true, "hIST": true,
+	"acTL": true, "fcTL": true, "fdAT": true,
+}
+
+// gifKeepApplications are the GIF application extensions which control
+// animation.
+var gifKeepApplications = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+}
+
+// stripMetadata removes metadata, such as GPS coordinates, camera serial
+// numbers and comments, from the file to be uploaded according to the
+// metadata policy. The image data is copied as it is, so nothing is lost.
+// Files we have encoded ourselves have no metadata to remove.
+func (s *Store) stripMetadata() error {
+	if s.Metadata == MetadataKeep {
+		return nil
+	}
+	filename := s.uploadSourceFilename()
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("could not read file: %s", err)
+	}
+
+	safe := s.Metadata != MetadataStrip
+	var stripped []byte
+	switch s.OriginalFormat {
+	case "jpeg":
+		stripped, err = stripJPEG(data, safe)
+	case "png":
+		stripped, err = stripPNG(data, safe)
+	case "gif":
+		stripped, err = stripGIF(data)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not remove metadata: %s", err)
+	}
+	if len(stripped) == len(data) {
+		return nil // nothing was removed
+	}
+
+	strippedFile, err := os.CreateTemp("", "dau_stripped_file_*")
+	if err != nil {
+		return err
+	}
+	defer strippedFile.Close()
+	_, err = strippedFile.Write(stripped)
+	if err != nil {
+		os.Remove(strippedFile.Name())
+		return err
+	}
+	daulog.Infof("removed %d bytes of metadata from %s", len(data)-len(stripped), filename)
+	s.StrippedFilename = strippedFile.Name()
+	return nil
+}
+
+// stripJPEG removes the application and comment segments of a JPEG. The
+// segments needed to decode the image properly are kept, and if safe is
+// true, so are the colour profile and orientation.
+func stripJPEG(data []byte, safe bool) ([]byte, error) {
+	r := bufio.NewReader(bytes.NewReader(data))
+	out := bytes.Buffer{}
+
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	out.Write(soi)
+
+	for {
+		marker, segment, err := readJPEGSegment(r)
+		if err != nil {
+			return nil, err
+		}
+		if marker == jpegEOI {
+			out.Write([]byte{0xff, marker})
+			return out.Bytes(), nil
+		}
+
+		segment, keep := keepJPEGSegment(marker, segment, safe)
+		if keep {
+			out.Write([]byte{0xff, marker})
+			binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+			out.Write(segment)
+		}
+		if marker == jpegSOS {
+			// the rest is image data
+			_, err = io.Copy(&out, r)
+			if err != nil {
+				return nil, err
+			}
+			return out.Bytes(), nil
+		}
+	}
+}
+
+// keepJPEGSegment decides if a segment should be kept, returning the data
+// to keep, which may be less than the segment had.
+func keepJPEGSegment(marker byte, data []byte, safe bool) ([]byte, bool) {
+	if marker == jpegCOM {
+		return nil, false
+	}
+	if marker < jpegAPP0 || marker > jpegAPP15 {
+		return data, true
+	}
+
+	switch {
+	case marker == jpegAPP0 && bytes.HasPrefix(data, jfifHeader) && len(data) >= 14:
+		// keep the header, without any thumbnail
+		jfif := append([]byte{}, data[:14]...)
+		jfif[12], jfif[13] = 0, 0
+		return jfif, true
+	case marker == jpegAPP14 && bytes.HasPrefix(data, adobeHeader):
+		// says how the colours are encoded
+		return data, true
+	case safe && marker == jpegAPP2 && bytes.HasPrefix(data, iccHeader):
+		return data, true
+	case safe && marker == jpegAPP1 && bytes.HasPrefix(data, exifHeader):
+		o := exifOrientation(data[len(exifHeader):])
+		if o == orientationNormal {
+			return nil, false
+		}
+		return append(append([]byte{}, exifHeader...), orientationExif(o)...), true
+	}
+	return nil, false
+}
+
+// orientationExif returns EXIF data containing only an orientation.
+func orientationExif(o int) []byte {
+	// big endian TIFF header, then an IFD with a single SHORT entry
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, byte(o), 0x00, 0x00)
+	return append(tiff, 0, 0, 0, 0) // no next IFD
+}
+
+// copyJPEGMetadata adds the metadata of the original JPEG to one we have
+// encoded, which has none, so it is not lost when an image is turned the
+// right way up. The orientation is reset to normal, and the segments which
+// describe how the original was encoded are left out.
+func copyJPEGMetadata(original, encoded []byte) ([]byte, error) {
+	if len(encoded) < 2 || encoded[0] != 0xff || encoded[1] != 0xd8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+	r := bufio.NewReader(bytes.NewReader(original))
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(r, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return nil, fmt.Errorf("not a jpeg")
+	}
+
+	out := bytes.Buffer{}
+	out.Write(encoded[:2])
+	for {
+		marker, segment, err := readJPEGSegment(r)
+		if err != nil {
+			return nil, err
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			break
+		}
+		if marker != jpegCOM && (marker < jpegAPP0 || marker > jpegAPP15) {
+			continue
+		}
+		if marker == jpegAPP0 && bytes.HasPrefix(segment, jfifHeader) ||
+			marker == jpegAPP14 && bytes.HasPrefix(segment, adobeHeader) {
+			continue
+		}
+		if marker == jpegAPP1 && bytes.HasPrefix(segment, exifHeader) {
+			segment = append(append([]byte{}, exifHeader...), uprightExif(segment[len(exifHeader):])...)
+		}
+		out.Write([]byte{0xff, marker})
+		binary.Write(&out, binary.BigEndian, uint16(len(segment)+2))
+		out.Write(segment)
+	}
+	out.Write(encoded[2:])
+	return out.Bytes(), nil
+}
+
+// stripPNG removes the ancillary chunks of a PNG, such as text and times,
+// except for those which affect how the image looks. If safe is true the
+// colour profile is also kept.
+func stripPNG(data []byte, safe bool) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, fmt.Errorf("not a png")
+	}
+	out := bytes.Buffer{}
+	out.Write(pngSignature)
+
+	for pos := len(pngSignature); pos < len(data); {
+		if pos+8 > len(data) {
+			return nil, fmt.Errorf("truncated png")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		chunkType := string(data[pos+4 : pos+8])
+		end := pos + 12 + length // length, type, data and crc
+		if length < 0 || end > len(data) {
+			return nil, fmt.Errorf("truncated png")
+		}
+
+		critical := chunkType[0] >= 'A' && chunkType[0] <= 'Z'
+		if critical || pngKeepChunks[chunkType] || (safe && chunkType == "iCCP") {
+			out.Write(data[pos:end])
+		}
+		pos = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// stripGIF removes comments, and application extensions other than those
+// controlling animation, from a GIF.
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return nil, fmt.Errorf("not a gif")
+	}
+	out := bytes.Buffer{}
+
+	// header, logical screen descriptor and global colour table
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&0x07 + 1)
+	}
+	if pos > len(data) {
+		return nil, fmt.Errorf("truncated gif")
+	}
+	out.Write(data[:pos])
+
+	for pos < len(data) {
+		start := pos
+		switch data[pos] {
+		case 0x3b: // trailer
+			out.WriteByte(0x3b)
+			return out.Bytes(), nil
+
+		case 0x21: // extension
+			if pos+2 > len(data) {
+				return nil, fmt.Errorf("truncated gif")
+			}
+			label := data[pos+1]
+			end, err := gifSubBlocksEnd(data, pos+2)
+			if err != nil {
+				return nil, err
+			}
+			keep := true
+			if label == 0xfe {
+				keep = false // comment
+			} else if label == 0xff {
+				// the first sub-block identifies the application
+				id := ""
+				if pos+3+11 <= len(data) && data[pos+2] == 11 {
+					id = string(data[pos+3 : pos+3+11])
+				}
+				keep = gifKeepApplications[id]
+			}
+			if keep {
+				out.Write(data[start:end])
+			}
+			pos = end
+
+		case 0x2c: // image descriptor, colour table and image data
+			if pos+10 > len(data) {
+				return nil, fmt.Errorf("truncated gif")
+			}
+			pos += 10
+			if data[start+9]&0x80 != 0 {
+				pos += 3 << (data[start+9]&0x07 + 1)
+			}
+			pos++ // LZW minimum code size
+			end, err := gifSubBlocksEnd(data, pos)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(data[start:end])
+			pos = end
+
+		default:
+			return nil, fmt.Errorf("unexpected gif block %x", data[pos])
+		}
+	}
+	return nil, fmt.Errorf("truncated gif")
+}
+
+// gifSubBlocksEnd returns the position after the sub-blocks starting at pos,
+// including the terminating empty block.
+func gifSubBlocksEnd(data []byte, pos int) (int, error) {
+	for {
+		if pos >= len(data) {
+			return 0, fmt.Errorf("truncated gif")
+		}
+		size := int(data[pos])
+		pos += 1 + size
+		if size == 0 {
+			return pos, nil
+		}
+	}
+}
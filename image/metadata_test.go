@@ -0,0 +1,234 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	i "image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func jpegSegment(marker byte, data []byte) []byte {
+	seg := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(seg[2:], uint16(len(data)+2))
+	return append(seg, data...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk[4:]))
+	return append(chunk, crc...)
+}
+
+func writeTemp(t *testing.T, ext string, data []byte) string {
+	f, err := os.CreateTemp("", "dautest-*."+ext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(data)
+	return f.Name()
+}
+
+// metadataJPEG returns a JPEG with EXIF, a colour profile and a comment,
+// along with the JPEG as it was encoded without them.
+func metadataJPEG(t *testing.T) ([]byte, []byte) {
+	im := i.NewRGBA(i.Rect(0, 0, 40, 30))
+	for p := range im.Pix {
+		im.Pix[p] = uint8(p)
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, im, nil); err != nil {
+		t.Fatal(err)
+	}
+	plain := buf.Bytes()
+
+	exif := append(append([]byte{}, exifHeader...), orientationExif(orientationNormal)...)
+	exif = append(exif, "GPS 51.5N 0.1W"...)
+	data := append([]byte{}, plain[:2]...)
+	data = append(data, jpegSegment(jpegAPP1, exif)...)
+	data = append(data, jpegSegment(jpegAPP2, append(append([]byte{}, iccHeader...), "profile"...))...)
+	data = append(data, jpegSegment(jpegCOM, []byte("secret comment"))...)
+	data = append(data, plain[2:]...)
+	return data, plain
+}
+
+func TestStripJPEG(t *testing.T) {
+	data, plain := metadataJPEG(t)
+
+	stripped, err := stripJPEG(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Errorf("expected the original jpeg back, got %d bytes instead of %d", len(stripped), len(plain))
+	}
+
+	safe, err := stripJPEG(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(safe, []byte("ICC_PROFILE")) {
+		t.Error("colour profile was removed")
+	}
+	if bytes.Contains(safe, []byte("GPS")) || bytes.Contains(safe, []byte("secret")) {
+		t.Error("metadata was not removed")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(safe)); err != nil {
+		t.Errorf("stripped jpeg does not decode: %s", err)
+	}
+}
+
+func TestStripJPEGKeepsOrientation(t *testing.T) {
+	exif := append(append([]byte{}, exifHeader...), orientationExif(orientationRotate90)...)
+	exif = append(exif, "GPS 51.5N 0.1W"...)
+	data := append([]byte{0xff, 0xd8}, jpegSegment(jpegAPP1, exif)...)
+	data = append(data, 0xff, 0xd9)
+
+	safe, err := stripJPEG(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(safe, []byte("GPS")) {
+		t.Error("metadata was not removed")
+	}
+	if o := jpegOrientation(bytes.NewReader(safe)); o != orientationRotate90 {
+		t.Errorf("orientation changed to %d", o)
+	}
+}
+
+func TestStripPNG(t *testing.T) {
+	im := i.NewNRGBA(i.Rect(0, 0, 8, 8))
+	buf := bytes.Buffer{}
+	png.Encode(&buf, im)
+	plain := buf.Bytes()
+
+	// after the signature and IHDR
+	ihdrEnd := len(pngSignature) + 12 + 13
+	data := append([]byte{}, plain[:ihdrEnd]...)
+	data = append(data, pngChunk("tEXt", []byte("Author\x00secret user"))...)
+	data = append(data, pngChunk("iCCP", []byte("profile"))...)
+	data = append(data, plain[ihdrEnd:]...)
+
+	stripped, err := stripPNG(data, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Errorf("expected the original png back, got %d bytes instead of %d", len(stripped), len(plain))
+	}
+	safe, err := stripPNG(data, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(safe, []byte("secret")) || !bytes.Contains(safe, []byte("iCCP")) {
+		t.Error("wrong chunks removed")
+	}
+	if _, err := png.Decode(bytes.NewReader(safe)); err != nil {
+		t.Errorf("stripped png does not decode: %s", err)
+	}
+}
+
+func TestStripGIF(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	g := &gif.GIF{LoopCount: 2}
+	for n := 0; n < 2; n++ {
+		g.Image = append(g.Image, i.NewPaletted(i.Rect(0, 0, 8, 8), pal))
+		g.Delay = append(g.Delay, 10)
+	}
+	buf := bytes.Buffer{}
+	gif.EncodeAll(&buf, g)
+	plain := buf.Bytes()
+
+	comment := []byte{0x21, 0xfe, 6}
+	comment = append(comment, "secret"...)
+	comment = append(comment, 0)
+	data := append(append([]byte{}, plain[:len(plain)-1]...), comment...)
+	data = append(data, 0x3b)
+
+	stripped, err := stripGIF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stripped, plain) {
+		t.Errorf("expected the original gif back, got %d bytes instead of %d", len(stripped), len(plain))
+	}
+	decoded, err := gif.DecodeAll(bytes.NewReader(stripped))
+	if err != nil || len(decoded.Image) != 2 || decoded.LoopCount != 2 {
+		t.Errorf("animation was not kept: %v", err)
+	}
+}
+
+func TestMetadataPolicy(t *testing.T) {
+	data, _ := metadataJPEG(t)
+	f := writeTemp(t, "jpg", data)
+	defer os.Remove(f)
+
+	for _, policy := range []string{"", MetadataSafe, MetadataStrip, MetadataKeep} {
+		s := Store{OriginalFilename: f, MaxBytes: 8_000_000, Metadata: policy}
+		if err := s.Prepare(); err != nil {
+			t.Fatalf("could not prepare: %s", err)
+		}
+		uploaded, _ := os.ReadFile(s.uploadSourceFilename())
+		s.Cleanup()
+
+		if policy == MetadataKeep {
+			if !bytes.Equal(uploaded, data) {
+				t.Errorf("policy %s changed the file", policy)
+			}
+			continue
+		}
+		if bytes.Contains(uploaded, []byte("GPS")) || bytes.Contains(uploaded, []byte("secret")) {
+			t.Errorf("policy '%s' did not remove metadata", policy)
+		}
+		if bytes.Contains(uploaded, []byte("ICC_PROFILE")) != (policy != MetadataStrip) {
+			t.Errorf("policy '%s' did the wrong thing with the colour profile", policy)
+		}
+	}
+}
+
+func TestMetadataPolicyRotated(t *testing.T) {
+	_, plain := metadataJPEG(t)
+	exif := append(append([]byte{}, exifHeader...), orientationExif(orientationRotate90)...)
+	exif = append(exif, "GPS 51.5N 0.1W"...)
+	data := append([]byte{}, plain[:2]...)
+	data = append(data, jpegSegment(jpegAPP1, exif)...)
+	data = append(data, jpegSegment(jpegAPP2, append(append([]byte{}, iccHeader...), "profile"...))...)
+	data = append(data, jpegSegment(jpegCOM, []byte("secret comment"))...)
+	data = append(data, plain[2:]...)
+	f := writeTemp(t, "jpg", data)
+	defer os.Remove(f)
+
+	for _, policy := range []string{MetadataSafe, MetadataStrip, MetadataKeep} {
+		s := Store{OriginalFilename: f, MaxBytes: 8_000_000, Metadata: policy}
+		if err := s.Prepare(); err != nil {
+			t.Fatalf("could not prepare: %s", err)
+		}
+		uploaded, _ := os.ReadFile(s.uploadSourceFilename())
+		s.Cleanup()
+
+		conf, err := jpeg.DecodeConfig(bytes.NewReader(uploaded))
+		if err != nil || conf.Width != 30 || conf.Height != 40 {
+			t.Errorf("policy '%s' did not turn the image, %v %v", policy, conf, err)
+		}
+		if o := jpegOrientation(bytes.NewReader(uploaded)); o != orientationNormal {
+			t.Errorf("policy '%s' left orientation %d on a turned image", policy, o)
+		}
+		kept := bytes.Contains(uploaded, []byte("GPS")) && bytes.Contains(uploaded, []byte("secret"))
+		if kept != (policy == MetadataKeep) {
+			t.Errorf("policy '%s' did the wrong thing with the metadata", policy)
+		}
+		if bytes.Contains(uploaded, []byte("ICC_PROFILE")) != (policy != MetadataStrip) {
+			t.Errorf("policy '%s' did the wrong thing with the colour profile", policy)
+		}
+	}
+}
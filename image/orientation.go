@@ -0,0 +1,238 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	i "image"
+	"io"
+	"os"
+
+	"golang.org/x/image/draw"
+)
+
+// EXIF orientations, which say how the pixels should be transformed to
+// display the image the right way up.
+const (
+	orientationNormal     = 1
+	orientationFlipH      = 2
+	orientationRotate180  = 3
+	orientationFlipV      = 4
+	orientationTranspose  = 5
+	orientationRotate90   = 6 // clockwise
+	orientationTransverse = 7
+	orientationRotate270  = 8 // clockwise
+)
+
+const exifTagOrientation = 0x0112
+
+// decodeFile decodes an image file, transforming it to be the right way
+// up according to its EXIF orientation. It also returns whether the pixels
+// had to be transformed.
+func decodeFile(filename string) (i.Image, string, bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("could not open file: %s", err)
+	}
+	defer file.Close()
+
+	im, format, err := i.Decode(file)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("could not decode file: %s", err)
+	}
+	if format != "jpeg" {
+		return im, format, false, nil
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", false, err
+	}
+	o := jpegOrientation(file)
+	if o == orientationNormal {
+		return im, format, false, nil
+	}
+	return orient(im, o), format, true, nil
+}
+
+// fileOrientation returns the EXIF orientation of an image file, which is
+// orientationNormal if the file has none, or is not a JPEG.
+func fileOrientation(filename string) int {
+	file, err := os.Open(filename)
+	if err != nil {
+		return orientationNormal
+	}
+	defer file.Close()
+	return jpegOrientation(file)
+}
+
+// jpegOrientation finds the orientation in the EXIF data of a JPEG.
+func jpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	soi := make([]byte, 2)
+	if _, err := io.ReadFull(br, soi); err != nil || soi[0] != 0xff || soi[1] != 0xd8 {
+		return orientationNormal
+	}
+	for {
+		marker, data, err := readJPEGSegment(br)
+		if err != nil || marker == jpegSOS || marker == jpegEOI {
+			return orientationNormal
+		}
+		if marker == jpegAPP1 && bytes.HasPrefix(data, exifHeader) {
+			return exifOrientation(data[len(exifHeader):])
+		}
+	}
+}
+
+// JPEG markers
+const (
+	jpegAPP1 = 0xe1
+	jpegSOS  = 0xda
+	jpegEOI  = 0xd9
+)
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// readJPEGSegment reads the next marker segment from a JPEG, after the start
+// of image marker, returning the marker and the segment's data. Image data
+// follows the start of scan segment, so reading must stop there.
+func readJPEGSegment(r *bufio.Reader) (byte, []byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if b != 0xff {
+		return 0, nil, fmt.Errorf("expected jpeg marker, got %x", b)
+	}
+	// markers may be padded with any number of 0xff bytes
+	marker := byte(0xff)
+	for marker == 0xff {
+		marker, err = r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if marker == jpegEOI || (marker >= 0xd0 && marker <= 0xd7) {
+		return marker, nil, nil // no length or data
+	}
+
+	var length uint16
+	err = binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length < 2 {
+		return 0, nil, fmt.Errorf("bad jpeg segment length %d", length)
+	}
+	data := make([]byte, length-2)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return 0, nil, err
+	}
+	return marker, data, nil
+}
+
+// exifOrientation reads the orientation tag from the first IFD of EXIF
+// data, which is laid out like a TIFF file.
+func exifOrientation(tiff []byte) int {
+	order, entry := exifOrientationEntry(tiff)
+	if entry < 0 {
+		return orientationNormal
+	}
+	// a single SHORT, stored at the start of the value field
+	o := int(order.Uint16(tiff[entry+8:]))
+	if o < orientationNormal || o > orientationRotate270 {
+		return orientationNormal
+	}
+	return o
+}
+
+// uprightExif returns a copy of the EXIF data with the orientation set to
+// normal, for an image which has been turned the right way up.
+func uprightExif(tiff []byte) []byte {
+	tiff = append([]byte{}, tiff...)
+	if order, entry := exifOrientationEntry(tiff); entry >= 0 {
+		order.PutUint16(tiff[entry+8:], orientationNormal)
+	}
+	return tiff
+}
+
+// exifOrientationEntry finds the orientation tag in the first IFD, returning
+// the byte order and the offset of its entry, or -1 if there is none.
+func exifOrientationEntry(tiff []byte) (binary.ByteOrder, int) {
+	if len(tiff) < 8 {
+		return nil, -1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, -1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return nil, -1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, -1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == exifTagOrientation {
+			return order, entry
+		}
+	}
+	return nil, -1
+}
+
+// orient transforms an image with the given EXIF orientation so it is the
+// right way up.
+func orient(im i.Image, o int) i.Image {
+	if o <= orientationNormal || o > orientationRotate270 {
+		return im
+	}
+
+	b := im.Bounds()
+	src := i.NewNRGBA(i.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Rect, im, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if o >= orientationTranspose {
+		dw, dh = h, w
+	}
+	dst := i.NewNRGBA(i.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch o {
+			case orientationFlipH:
+				sx, sy = w-1-x, y
+			case orientationRotate180:
+				sx, sy = w-1-x, h-1-y
+			case orientationFlipV:
+				sx, sy = x, h-1-y
+			case orientationTranspose:
+				sx, sy = y, x
+			case orientationRotate90:
+				sx, sy = y, h-1-x
+			case orientationTransverse:
+				sx, sy = w-1-y, h-1-x
+			case orientationRotate270:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,124 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	i "image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+// exifJPEG writes a JPEG with an EXIF orientation, the left half red and
+// the right half blue, returning its filename.
+func exifJPEG(t *testing.T, width, height, orientation int) string {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= width/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			im.Set(x, y, c)
+		}
+	}
+	buf := bytes.Buffer{}
+	if err := jpeg.Encode(&buf, im, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+
+	app1 := append([]byte{0xff, 0xe1, 0, 0}, exifHeader...)
+	app1 = append(app1, orientationExif(orientation)...)
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(app1)-2))
+
+	data := buf.Bytes()
+	f, err := os.CreateTemp("", "dautest-*.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(data[:2])
+	f.Write(app1)
+	f.Write(data[2:])
+	return f.Name()
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xc000 && g < 0x4000 && b < 0x4000
+}
+
+func TestOrient(t *testing.T) {
+	// a 3x2 image, with only the top left pixel set
+	im := i.NewNRGBA(i.Rect(0, 0, 3, 2))
+	im.Set(0, 0, color.White)
+
+	corners := map[int]i.Point{
+		orientationNormal:     {0, 0},
+		orientationFlipH:      {2, 0},
+		orientationRotate180:  {2, 1},
+		orientationFlipV:      {0, 1},
+		orientationTranspose:  {0, 0},
+		orientationRotate90:   {1, 0},
+		orientationTransverse: {1, 2},
+		orientationRotate270:  {0, 2},
+	}
+	for o, p := range corners {
+		out := orient(im, o)
+		size := out.Bounds().Size()
+		if (o >= orientationTranspose && size != i.Pt(2, 3)) || (o < orientationTranspose && size != i.Pt(3, 2)) {
+			t.Errorf("orientation %d gave size %v", o, size)
+		}
+		if _, _, _, a := out.At(p.X, p.Y).RGBA(); a == 0 {
+			t.Errorf("orientation %d did not move the top left pixel to %v", o, p)
+		}
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	f := exifJPEG(t, 512, 256, orientationRotate90)
+	defer os.Remove(f)
+
+	if o := fileOrientation(f); o != orientationRotate90 {
+		t.Fatalf("expected orientation %d, got %d", orientationRotate90, o)
+	}
+	w, h, err := Dimensions(f)
+	if err != nil || w != 256 || h != 512 {
+		t.Errorf("expected dimensions 256x512, got %dx%d", w, h)
+	}
+
+	s := Store{OriginalFilename: f, MaxBytes: 8_000_000}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+	if s.ConvertedFilename == "" || s.OriginalFormat != "jpeg" {
+		t.Fatalf("image was not rotated")
+	}
+	// the left of the image is now at the top
+	im, _, _, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.Bounds().Dx() != 256 || !isRed(im.At(128, 64)) || isRed(im.At(128, 448)) {
+		t.Errorf("rotated image is wrong, %v", im.Bounds())
+	}
+
+	thumb := bytes.Buffer{}
+	if err := s.ThumbPNG(ThumbTypeOriginal, DefaultThumbSize, &thumb); err != nil {
+		t.Fatal(err)
+	}
+	conf, _, err := i.DecodeConfig(&thumb)
+	if err != nil || conf.Width >= conf.Height {
+		t.Errorf("thumbnail is not upright, %dx%d", conf.Width, conf.Height)
+	}
+}
+
+func TestNoExifOrientation(t *testing.T) {
+	f := tempNoise(t, 20, 10, "jpeg", 80)
+	defer os.Remove(f)
+	if o := fileOrientation(f); o != orientationNormal {
+		t.Errorf("expected normal orientation, got %d", o)
+	}
+}
@@ -0,0 +1,263 @@
+package image
+
+import (
+	"fmt"
+	i "image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	"golang.org/x/image/draw"
+)
+
+// Redaction modes
+const (
+	RedactBlur     = "blur"
+	RedactPixelate = "pixelate"
+	RedactFill     = "fill"
+)
+
+// Redaction hides part of an image.
+type Redaction struct {
+	X, Y, Width, Height float64
+	Mode                string // one of the Redact modes
+	Colour              string // for RedactFill, as #rrggbb, black if empty
+}
+
+// Validate checks the redaction can be applied. If relative is true the
+// position and size must be fractions of the image size.
+func (r Redaction) Validate(relative bool) error {
+	if r.Mode != RedactBlur && r.Mode != RedactPixelate && r.Mode != RedactFill {
+		return fmt.Errorf("redaction mode should be one of %s, %s or %s - '%s' invalid", RedactBlur, RedactPixelate, RedactFill, r.Mode)
+	}
+	if r.X < 0 || r.Y < 0 || r.Width <= 0 || r.Height <= 0 {
+		return fmt.Errorf("redaction must have a positive size and position")
+	}
+	if relative && (r.X+r.Width > 1 || r.Y+r.Height > 1) {
+		return fmt.Errorf("redaction must be within the image, given as fractions of its size")
+	}
+	if r.Mode == RedactFill && r.Colour != "" {
+		c, err := parseColour(r.Colour)
+		if err != nil {
+			return err
+		}
+		// anything hidden by a translucent fill could still be read
+		if c.(color.NRGBA).A != 0xff {
+			return fmt.Errorf("redaction colour must be opaque, like #rrggbb - '%s' invalid", r.Colour)
+		}
+	}
+	return nil
+}
+
+// rect returns the area of the image the redaction covers. If relative is
+// true the redaction is given in fractions of the image size, otherwise in
+// pixels.
+func (r Redaction) rect(bounds i.Rectangle, relative bool) i.Rectangle {
+	x, y, w, h := r.X, r.Y, r.Width, r.Height
+	if relative {
+		x, w = x*float64(bounds.Dx()), w*float64(bounds.Dx())
+		y, h = y*float64(bounds.Dy()), h*float64(bounds.Dy())
+	}
+	rect := i.Rect(int(math.Floor(x)), int(math.Floor(y)), int(math.Ceil(x+w)), int(math.Ceil(y+h)))
+	return rect.Add(bounds.Min).Intersect(bounds)
+}
+
+// redactions returns every area to be redacted in an image with the given
+// bounds, the watcher's as well as those set for this upload.
+func (s *Store) redactions(bounds i.Rectangle) ([]i.Rectangle, []Redaction) {
+	rects := []i.Rectangle{}
+	all := []Redaction{}
+	for _, r := range s.FixedRedactions {
+		rects = append(rects, r.rect(bounds, true))
+		all = append(all, r)
+	}
+	for _, r := range s.Redactions {
+		rects = append(rects, r.rect(bounds, false))
+		all = append(all, r)
+	}
+	return rects, all
+}
+
+// redactImage returns a copy of the image with the store's redactions
+// applied.
+func (s *Store) redactImage(im i.Image) i.Image {
+	rects, redactions := s.redactions(im.Bounds())
+	if len(rects) == 0 {
+		return im
+	}
+	dst := i.NewRGBA(im.Bounds())
+	draw.Draw(dst, dst.Rect, im, im.Bounds().Min, draw.Src)
+	for n, rect := range rects {
+		if rect.Empty() {
+			continue
+		}
+		switch redactions[n].Mode {
+		case RedactBlur:
+			blur(dst, rect)
+		case RedactPixelate:
+			pixelate(dst, rect)
+		case RedactFill:
+			c := color.NRGBA{A: 0xff}
+			if redactions[n].Colour != "" {
+				parsed, err := parseColour(redactions[n].Colour)
+				if err != nil {
+					daulog.Errorf("filling redaction with black: %s", err)
+				} else {
+					c = parsed.(color.NRGBA)
+					c.A = 0xff
+				}
+			}
+			// drawn over the image, rather than blended with it, so nothing
+			// shows through
+			draw.Draw(dst, rect, i.NewUniform(c), i.Point{}, draw.Src)
+		}
+	}
+	return dst
+}
+
+// applyRedactions hides the parts of the image the watcher and user asked
+// for, at full resolution, before anything else is drawn on it.
+func (s *Store) applyRedactions() error {
+	if len(s.FixedRedactions) == 0 && len(s.Redactions) == 0 {
+		return nil
+	}
+
+	var redacted string
+	var err error
+	if s.OriginalFormat == "gif" {
+		redacted, err = rewriteGIF(s.uploadSourceFilename(), gifOptions{scale: 1, frameStep: 1, colours: 256, edit: s.redactImage})
+		if err != nil {
+			return err
+		}
+	} else {
+		redacted, err = s.writeEdited(s.redactImage, "dau_redact_file_*")
+		if err != nil {
+			return err
+		}
+	}
+	daulog.Infof("redacted %d areas of %s", len(s.FixedRedactions)+len(s.Redactions), s.uploadSourceFilename())
+	s.RedactedFilename = redacted
+	return nil
+}
+
+// writeEdited decodes the file to be uploaded, changes it with edit and
+// writes it to a new temporary file in the same format, returning its name.
+func (s *Store) writeEdited(edit func(i.Image) i.Image, pattern string) (string, error) {
+	im, _, _, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		return "", err
+	}
+	im = edit(im)
+
+	out, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	switch s.OriginalFormat {
+	case "png":
+		err = png.Encode(out, im)
+	case "jpeg":
+		err = jpeg.Encode(out, im, &jpeg.Options{Quality: 90})
+	default:
+		err = fmt.Errorf("cannot edit format %s", s.OriginalFormat)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
+
+// blur blurs an area of the image heavily enough that text cannot be read,
+// with three passes of a box blur.
+func blur(im *i.RGBA, rect i.Rectangle) {
+	radius := maxInt(6, minInt(rect.Dx(), rect.Dy())/8)
+	for pass := 0; pass < 3; pass++ {
+		boxBlur(im, rect, radius, true)
+		boxBlur(im, rect, radius, false)
+	}
+}
+
+// boxBlur averages each pixel in the area with its neighbours, in one
+// direction. Pixels outside the area are not used, so nothing from inside
+// is left in them and nothing hidden leaks out.
+func boxBlur(im *i.RGBA, rect i.Rectangle, radius int, horizontal bool) {
+	lines, length := rect.Dy(), rect.Dx()
+	if !horizontal {
+		lines, length = rect.Dx(), rect.Dy()
+	}
+	offset := func(line, pos int) int {
+		if horizontal {
+			return im.PixOffset(rect.Min.X+pos, rect.Min.Y+line)
+		}
+		return im.PixOffset(rect.Min.X+line, rect.Min.Y+pos)
+	}
+
+	src := make([]uint8, length*4)
+	for line := 0; line < lines; line++ {
+		for pos := 0; pos < length; pos++ {
+			copy(src[pos*4:pos*4+4], im.Pix[offset(line, pos):offset(line, pos)+4])
+		}
+		// running sums over the window, clamped to the area
+		var sum [4]int
+		count := 0
+		for pos := 0; pos <= radius && pos < length; pos++ {
+			for c := 0; c < 4; c++ {
+				sum[c] += int(src[pos*4+c])
+			}
+			count++
+		}
+		for pos := 0; pos < length; pos++ {
+			o := offset(line, pos)
+			for c := 0; c < 4; c++ {
+				im.Pix[o+c] = uint8(sum[c] / count)
+			}
+			if add := pos + radius + 1; add < length {
+				for c := 0; c < 4; c++ {
+					sum[c] += int(src[add*4+c])
+				}
+				count++
+			}
+			if remove := pos - radius; remove >= 0 {
+				for c := 0; c < 4; c++ {
+					sum[c] -= int(src[remove*4+c])
+				}
+				count--
+			}
+		}
+	}
+}
+
+// pixelate replaces blocks of the area with their average colour.
+func pixelate(im *i.RGBA, rect i.Rectangle) {
+	block := maxInt(8, minInt(rect.Dx(), rect.Dy())/6)
+	for by := rect.Min.Y; by < rect.Max.Y; by += block {
+		for bx := rect.Min.X; bx < rect.Max.X; bx += block {
+			b := i.Rect(bx, by, bx+block, by+block).Intersect(rect)
+			var sum [4]int
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					o := im.PixOffset(x, y)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(im.Pix[o+c])
+					}
+				}
+			}
+			n := b.Dx() * b.Dy()
+			avg := color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+			draw.Draw(im, b, i.NewUniform(avg), i.Point{}, draw.Src)
+		}
+	}
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
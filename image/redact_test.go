@@ -0,0 +1,157 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"golang.org/x/image/draw"
+)
+
+// stripes returns an image of one pixel wide black and white stripes,
+// which any redaction should smooth out.
+func stripes(width, height int) *i.RGBA {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x%2 == 0 {
+				im.Set(x, y, color.White)
+			} else {
+				im.Set(x, y, color.Black)
+			}
+		}
+	}
+	return im
+}
+
+func TestRedactionRect(t *testing.T) {
+	bounds := i.Rect(0, 0, 200, 100)
+	r := Redaction{X: 0.5, Y: 0.25, Width: 0.5, Height: 0.5}
+	if got := r.rect(bounds, true); got != i.Rect(100, 25, 200, 75) {
+		t.Errorf("wrong relative rectangle %v", got)
+	}
+	r = Redaction{X: 150, Y: 50, Width: 100, Height: 100}
+	if got := r.rect(bounds, false); got != i.Rect(150, 50, 200, 100) {
+		t.Errorf("rectangle not clipped to the image, %v", got)
+	}
+}
+
+func TestRedactionValidate(t *testing.T) {
+	if err := (Redaction{X: 1, Y: 1, Width: 10, Height: 10, Mode: RedactBlur}).Validate(false); err != nil {
+		t.Errorf("pixel redaction should be valid: %s", err)
+	}
+	bad := []Redaction{
+		{Width: 10, Height: 10, Mode: "smudge"},
+		{Width: 0, Height: 10, Mode: RedactFill},
+		{Width: 10, Height: 10, Mode: RedactFill, Colour: "red"},
+		{Width: 10, Height: 10, Mode: RedactFill, Colour: "#ff000080"},
+	}
+	for _, r := range bad {
+		if err := r.Validate(false); err == nil {
+			t.Errorf("%#v should be invalid", r)
+		}
+	}
+	if err := (Redaction{X: 0.5, Width: 0.6, Height: 0.1, Mode: RedactBlur}).Validate(true); err == nil {
+		t.Error("relative redaction outside the image should be invalid")
+	}
+}
+
+func TestRedactModes(t *testing.T) {
+	for _, mode := range []string{RedactBlur, RedactPixelate, RedactFill} {
+		s := Store{
+			FixedRedactions: []Redaction{{X: 0, Y: 0, Width: 0.5, Height: 0.5, Mode: mode, Colour: "#ff0000"}},
+		}
+		im := s.redactImage(stripes(100, 100)).(*i.RGBA)
+
+		// inside, neighbouring pixels are no longer different
+		r1, _, _, _ := im.At(20, 20).RGBA()
+		r2, _, _, _ := im.At(21, 20).RGBA()
+		if d := int(r1) - int(r2); d > 0x1000 || d < -0x1000 {
+			t.Errorf("%s: stripes still visible, %x and %x", mode, r1, r2)
+		}
+		if mode == RedactFill {
+			if r, g, b, _ := im.At(20, 20).RGBA(); r != 0xffff || g != 0 || b != 0 {
+				t.Errorf("fill is not red")
+			}
+		}
+		// outside, nothing has changed
+		if r, _, _, _ := im.At(60, 60).RGBA(); r != 0xffff {
+			t.Errorf("%s: pixels outside the redaction changed", mode)
+		}
+		if r, _, _, _ := im.At(51, 20).RGBA(); r != 0 {
+			t.Errorf("%s: pixels next to the redaction changed", mode)
+		}
+	}
+}
+
+func TestRedactUpload(t *testing.T) {
+	f, err := os.CreateTemp("", "dautest-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, stripes(100, 100))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := Store{
+		OriginalFilename: f.Name(),
+		MaxBytes:         8_000_000,
+		Redactions:       []Redaction{{X: 50, Y: 50, Width: 50, Height: 50, Mode: RedactFill}},
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+	if s.RedactedFilename == "" {
+		t.Fatal("no redacted file")
+	}
+	im, _, _, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, g, b, _ := im.At(80, 80).RGBA(); r+g+b != 0 {
+		t.Error("area was not filled")
+	}
+	if r, _, _, _ := im.At(20, 20).RGBA(); r != 0xffff {
+		t.Error("area outside the redaction changed")
+	}
+}
+
+func TestRedactGIF(t *testing.T) {
+	f := tempGIF(t, 100, 100, 3, false)
+	defer os.Remove(f)
+
+	s := Store{
+		OriginalFilename: f,
+		MaxBytes:         8_000_000,
+		FixedRedactions:  []Redaction{{X: 0, Y: 0, Width: 1, Height: 0.2, Mode: RedactFill, Colour: "#000000"}},
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	g := decodeGIF(t, s.uploadSourceFilename())
+	if len(g.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(g.Image))
+	}
+	for n, frame := range g.Image {
+		if r, gr, b, _ := frame.At(50, 10).RGBA(); r+gr+b != 0 {
+			t.Errorf("frame %d was not redacted", n)
+		}
+	}
+}
+
+func TestRedactFillOpaque(t *testing.T) {
+	im := i.NewRGBA(i.Rect(0, 0, 20, 20))
+	draw.Draw(im, im.Rect, i.NewUniform(color.White), i.Point{}, draw.Src)
+
+	// a translucent colour which got past validation still hides everything
+	s := Store{Redactions: []Redaction{{Width: 10, Height: 10, Mode: RedactFill, Colour: "#ff000080"}}}
+	r, g, b, a := s.redactImage(im).At(5, 5).RGBA()
+	if r != 0xffff || g != 0 || b != 0 || a != 0xffff {
+		t.Errorf("fill is not opaque red, got %x %x %x %x", r, g, b, a)
+	}
+}
@@ -1,19 +1,23 @@
 package image
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"fmt"
 	i "image"
 	"image/png"
 	"io"
-	"log"
+	"math"
 	"os"
 
 	"golang.org/x/image/draw"
 )
 
+// Thumbnail sizes, the longest side in pixels
 const (
-	thumbnailMaxX = 128
-	thumbnailMaxY = 128
+	DefaultThumbSize = 128
+	MinThumbSize     = 16
+	MaxThumbSize     = 1024
 )
 
 type ThumbType = string
@@ -21,42 +25,81 @@ type ThumbType = string
 const ThumbTypeOriginal = "orig"
 const ThumbTypeMarkedUp = "markedup"
 
-// ThumbPNG writes a thumbnail out to an io.Writer
-func (ip *Store) ThumbPNG(t ThumbType, w io.Writer) error {
-
-	var filename string
-	if t == ThumbTypeOriginal {
-		filename = ip.OriginalFilename
-	} else if t == ThumbTypeMarkedUp {
-		filename = ip.ModifiedFilename
-	} else {
-		log.Fatal("was passed incorrect 'type' arg")
+// thumbFilename returns the file a thumbnail of the given type is made from.
+func (ip *Store) thumbFilename(t ThumbType) (string, error) {
+	switch t {
+	case ThumbTypeOriginal:
+		return ip.OriginalFilename, nil
+	case ThumbTypeMarkedUp:
+		if ip.ModifiedFilename == "" {
+			return "", fmt.Errorf("image has not been marked up")
+		}
+		return ip.ModifiedFilename, nil
 	}
+	return "", fmt.Errorf("unknown thumbnail type '%s'", t)
+}
 
-	file, err := os.Open(filename)
+// ThumbTag returns a tag for the thumbnail of the given type and size, which
+// changes whenever the thumbnail would. It is suitable for an HTTP ETag and
+// is used as the key for the thumbnail cache.
+func (ip *Store) ThumbTag(t ThumbType, size int) (string, error) {
+	filename, err := ip.thumbFilename(t)
 	if err != nil {
-		return fmt.Errorf("could not open file: %s", err)
+		return "", err
 	}
-	defer file.Close()
-	im, _, err := i.Decode(file)
+	info, err := os.Stat(filename)
 	if err != nil {
-		return fmt.Errorf("could not decode file: %s", err)
+		return "", err
 	}
+	// the preview also shows the redactions and transform
+	key := fmt.Sprintf("%s|%d|%d|%d|%v|%v|%v", filename, size, info.ModTime().UnixNano(), info.Size(), ip.FixedRedactions, ip.Redactions, ip.Transform)
+	return fmt.Sprintf("%x", sha1.Sum([]byte(key))), nil
+}
 
-	newXY := i.Point{}
-	if im.Bounds().Max.X/thumbnailMaxX > im.Bounds().Max.Y/thumbnailMaxY {
-		newXY.X = thumbnailMaxX
-		newXY.Y = im.Bounds().Max.Y / (im.Bounds().Max.X / thumbnailMaxX)
-	} else {
-		newXY.Y = thumbnailMaxY
-		newXY.X = im.Bounds().Max.X / (im.Bounds().Max.Y / thumbnailMaxY)
+// ThumbPNG writes a PNG thumbnail no more than size pixels wide or high out
+// to an io.Writer. Thumbnails are cached, so repeated requests do not decode
+// the image again.
+func (ip *Store) ThumbPNG(t ThumbType, size int, w io.Writer) error {
+	if size < MinThumbSize || size > MaxThumbSize {
+		return fmt.Errorf("thumbnail size should be between %d and %d - '%d' invalid", MinThumbSize, MaxThumbSize, size)
+	}
+	tag, err := ip.ThumbTag(t, size)
+	if err != nil {
+		return err
+	}
+	if data, ok := thumbs.get(tag); ok {
+		_, err = w.Write(data)
+		return err
 	}
 
-	dst := i.NewRGBA(i.Rect(0, 0, newXY.X, newXY.Y))
-	draw.BiLinear.Scale(dst, dst.Rect, im, im.Bounds(), draw.Over, nil)
+	filename, _ := ip.thumbFilename(t)
+	im, _, _, err := decodeFile(filename)
+	if err != nil {
+		return err
+	}
+	// preview the redactions and transform which will be applied
+	im = ip.Transform.apply(ip.redactImage(im))
 
-	png.Encode(w, dst)
+	width, height := thumbSize(im.Bounds().Dx(), im.Bounds().Dy(), size)
+	dst := i.NewRGBA(i.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(dst, dst.Rect, im, im.Bounds(), draw.Over, nil)
 
-	return nil
+	buf := bytes.Buffer{}
+	if err := png.Encode(&buf, dst); err != nil {
+		return err
+	}
+	thumbs.add(tag, buf.Bytes())
+	_, err = w.Write(buf.Bytes())
+	return err
+}
 
+// thumbSize returns the size of the thumbnail of an image, keeping its
+// shape. Images already small enough are not enlarged.
+func thumbSize(width, height, size int) (int, int) {
+	longest := maxInt(width, height)
+	if longest <= size {
+		return width, height
+	}
+	scale := float64(size) / float64(longest)
+	return maxInt(1, int(math.Round(float64(width)*scale))), maxInt(1, int(math.Round(float64(height)*scale)))
 }
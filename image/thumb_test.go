@@ -0,0 +1,100 @@
+package image
+
+import (
+	"bytes"
+	i "image"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestThumbSize(t *testing.T) {
+	tests := []struct {
+		width, height, size int
+		wantW, wantH        int
+	}{
+		{1024, 512, 128, 128, 64},
+		{512, 1024, 128, 64, 128},
+		{64, 32, 128, 64, 32},
+		{1000, 1, 100, 100, 1},
+		{300, 200, 16, 16, 11},
+	}
+	for _, tc := range tests {
+		w, h := thumbSize(tc.width, tc.height, tc.size)
+		if w != tc.wantW || h != tc.wantH {
+			t.Errorf("%dx%d at %d: expected %dx%d, got %dx%d", tc.width, tc.height, tc.size, tc.wantW, tc.wantH, w, h)
+		}
+	}
+}
+
+func TestThumbSmallImage(t *testing.T) {
+	f := tempNoise(t, 64, 32, "png", 0)
+	defer os.Remove(f)
+
+	s := Store{OriginalFilename: f}
+	thumb := bytes.Buffer{}
+	if err := s.ThumbPNG(ThumbTypeOriginal, DefaultThumbSize, &thumb); err != nil {
+		t.Fatal(err)
+	}
+	conf, _, err := i.DecodeConfig(&thumb)
+	if err != nil || conf.Width != 64 || conf.Height != 32 {
+		t.Errorf("wrong thumbnail size %dx%d", conf.Width, conf.Height)
+	}
+
+	if err := s.ThumbPNG(ThumbTypeOriginal, 10, &thumb); err == nil {
+		t.Error("tiny size should be an error")
+	}
+	if err := s.ThumbPNG(ThumbTypeMarkedUp, DefaultThumbSize, &thumb); err == nil {
+		t.Error("image has not been marked up")
+	}
+}
+
+func TestThumbTag(t *testing.T) {
+	f := tempNoise(t, 300, 200, "png", 0)
+	defer os.Remove(f)
+	s := Store{OriginalFilename: f}
+
+	tag, err := s.ThumbTag(ThumbTypeOriginal, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := s.ThumbTag(ThumbTypeOriginal, 256); other == tag {
+		t.Error("tag does not change with size")
+	}
+	s.Redactions = []Redaction{{Width: 10, Height: 10, Mode: RedactFill}}
+	if other, _ := s.ThumbTag(ThumbTypeOriginal, 128); other == tag {
+		t.Error("tag does not change with redactions")
+	}
+	s.Redactions = nil
+
+	// a new file is a new thumbnail, even though it has the same name
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(f, later, later)
+	if other, _ := s.ThumbTag(ThumbTypeOriginal, 128); other == tag {
+		t.Error("tag does not change with the file")
+	}
+}
+
+func TestThumbCache(t *testing.T) {
+	c := newThumbCache(10)
+	c.add("a", []byte("1234"))
+	c.add("b", []byte("1234"))
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("a is not cached")
+	}
+	// b is now the least recently used
+	c.add("c", []byte("1234"))
+	if _, ok := c.get("b"); ok {
+		t.Error("b should have been removed")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("a should still be cached")
+	}
+	c.add("big", []byte("12345678901"))
+	if _, ok := c.get("big"); ok {
+		t.Error("entries bigger than the cache should not be kept")
+	}
+	if c.bytes != 8 {
+		t.Errorf("expected 8 bytes cached, got %d", c.bytes)
+	}
+}
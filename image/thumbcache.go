@@ -0,0 +1,73 @@
+package image
+
+import (
+	"container/list"
+	"sync"
+)
+
+// thumbCacheBytes is how much memory cached thumbnails may use.
+const thumbCacheBytes = 32 * 1024 * 1024
+
+// thumbs holds recently made thumbnails.
+var thumbs = newThumbCache(thumbCacheBytes)
+
+// thumbCache is a least recently used cache of encoded thumbnails, limited
+// by their total size.
+type thumbCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List // front is the most recently used
+	entries  map[string]*list.Element
+}
+
+type thumbEntry struct {
+	key  string
+	data []byte
+}
+
+func newThumbCache(maxBytes int) *thumbCache {
+	return &thumbCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// get returns the cached thumbnail for the key, if there is one.
+func (c *thumbCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*thumbEntry).data, true
+}
+
+// add caches a thumbnail, removing the least recently used ones to make
+// room. Thumbnails bigger than the whole cache are not kept.
+func (c *thumbCache) add(key string, data []byte) {
+	if len(data) > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.bytes -= len(e.Value.(*thumbEntry).data)
+		e.Value.(*thumbEntry).data = data
+		c.bytes += len(data)
+		c.order.MoveToFront(e)
+	} else {
+		c.entries[key] = c.order.PushFront(&thumbEntry{key: key, data: data})
+		c.bytes += len(data)
+	}
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*thumbEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.bytes -= len(entry.data)
+	}
+}
@@ -0,0 +1,240 @@
+package image
+
+import (
+	"fmt"
+	i "image"
+	"math"
+	"strconv"
+	"strings"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+
+	"golang.org/x/image/draw"
+)
+
+// trimTolerance is how far, in 8 bit colour levels, a pixel may be from the
+// rest of a border and still count as part of it. Compression artifacts mean
+// borders are rarely exactly one colour.
+const trimTolerance = 12
+
+// Transform crops, scales, rotates and flips images. The steps are applied
+// in the order of the fields. The zero value leaves images unchanged.
+type Transform struct {
+	// CropX, CropY, CropWidth and CropHeight keep part of the image, as
+	// fractions of its size. Ignored if the width or height is 0.
+	CropX, CropY, CropWidth, CropHeight float64
+	TrimBorders                         bool   // remove rows and columns of a single colour from the edges
+	AspectRatio                         string // like "16:9", crops the middle of the image to this shape
+	Rotate                              int    // degrees clockwise: 0, 90, 180 or 270
+	FlipH, FlipV                        bool
+	MaxDimension                        int // scales the image down so neither side is longer, 0 for no limit
+}
+
+// IsZero returns true if the transform does nothing.
+func (t Transform) IsZero() bool {
+	return t == Transform{}
+}
+
+// Validate checks the transform can be applied.
+func (t Transform) Validate() error {
+	if t.CropWidth != 0 || t.CropHeight != 0 {
+		if t.CropX < 0 || t.CropY < 0 || t.CropWidth <= 0 || t.CropHeight <= 0 || t.CropX+t.CropWidth > 1 || t.CropY+t.CropHeight > 1 {
+			return fmt.Errorf("crop should be given as fractions of the image size, within the image")
+		}
+	}
+	if t.AspectRatio != "" {
+		if _, err := parseAspectRatio(t.AspectRatio); err != nil {
+			return err
+		}
+	}
+	if t.Rotate != 0 && t.Rotate != 90 && t.Rotate != 180 && t.Rotate != 270 {
+		return fmt.Errorf("rotation should be 0, 90, 180 or 270 - '%d' invalid", t.Rotate)
+	}
+	if t.MaxDimension < 0 {
+		return fmt.Errorf("maximum dimension cannot be negative - '%d' invalid", t.MaxDimension)
+	}
+	return nil
+}
+
+// parseAspectRatio parses a ratio like "16:9".
+func parseAspectRatio(s string) (float64, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 2 {
+		w, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		h, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err1 == nil && err2 == nil && w > 0 && h > 0 {
+			return w / h, nil
+		}
+	}
+	return 0, fmt.Errorf("aspect ratio should look like 16:9 - '%s' invalid", s)
+}
+
+// transformPlan is a transform worked out for a particular image, so the
+// frames of an animation are all changed in the same way.
+type transformPlan struct {
+	crop          i.Rectangle
+	orientations  []int // EXIF orientations to apply, in order
+	width, height int   // final size
+}
+
+// plan works out what the transform does to an image.
+func (t Transform) plan(im i.Image) transformPlan {
+	b := im.Bounds()
+	crop := b
+	if t.CropWidth > 0 && t.CropHeight > 0 {
+		r := Redaction{X: t.CropX, Y: t.CropY, Width: t.CropWidth, Height: t.CropHeight}
+		if c := r.rect(b, true); !c.Empty() {
+			crop = c
+		}
+	}
+	if t.TrimBorders {
+		crop = trimmed(im, crop)
+	}
+	if ratio, err := parseAspectRatio(t.AspectRatio); t.AspectRatio != "" && err == nil {
+		crop = aspectCrop(crop, ratio)
+	}
+
+	p := transformPlan{crop: crop, width: crop.Dx(), height: crop.Dy()}
+	switch t.Rotate {
+	case 90:
+		p.orientations = append(p.orientations, orientationRotate90)
+	case 180:
+		p.orientations = append(p.orientations, orientationRotate180)
+	case 270:
+		p.orientations = append(p.orientations, orientationRotate270)
+	}
+	if t.Rotate == 90 || t.Rotate == 270 {
+		p.width, p.height = p.height, p.width
+	}
+	if t.FlipH {
+		p.orientations = append(p.orientations, orientationFlipH)
+	}
+	if t.FlipV {
+		p.orientations = append(p.orientations, orientationFlipV)
+	}
+
+	if longest := maxInt(p.width, p.height); t.MaxDimension > 0 && longest > t.MaxDimension {
+		scale := float64(t.MaxDimension) / float64(longest)
+		p.width = int(math.Max(1, math.Round(float64(p.width)*scale)))
+		p.height = int(math.Max(1, math.Round(float64(p.height)*scale)))
+	}
+	return p
+}
+
+// apply transforms an image according to the plan.
+func (p transformPlan) apply(im i.Image) i.Image {
+	cropped := i.NewRGBA(i.Rect(0, 0, p.crop.Dx(), p.crop.Dy()))
+	draw.Draw(cropped, cropped.Rect, im, p.crop.Min, draw.Src)
+	var out i.Image = cropped
+
+	for _, o := range p.orientations {
+		out = orient(out, o)
+	}
+	if b := out.Bounds(); b.Dx() != p.width || b.Dy() != p.height {
+		scaled := i.NewRGBA(i.Rect(0, 0, p.width, p.height))
+		draw.CatmullRom.Scale(scaled, scaled.Rect, out, b, draw.Src, nil)
+		out = scaled
+	}
+	return out
+}
+
+// apply transforms an image.
+func (t Transform) apply(im i.Image) i.Image {
+	if t.IsZero() {
+		return im
+	}
+	return t.plan(im).apply(im)
+}
+
+// applyTransform crops, scales, rotates and flips the image as the watcher
+// asks, before it is fitted to the upload limit.
+func (s *Store) applyTransform() error {
+	if s.Transform.IsZero() {
+		return nil
+	}
+
+	var transformed string
+	var err error
+	if s.OriginalFormat == "gif" {
+		// every frame must be changed in the same way as the first
+		var plan *transformPlan
+		edit := func(im i.Image) i.Image {
+			if plan == nil {
+				p := s.Transform.plan(im)
+				plan = &p
+			}
+			return plan.apply(im)
+		}
+		transformed, err = rewriteGIF(s.uploadSourceFilename(), gifOptions{scale: 1, frameStep: 1, colours: 256, edit: edit})
+	} else {
+		transformed, err = s.writeEdited(s.Transform.apply, "dau_transform_file_*")
+	}
+	if err != nil {
+		return err
+	}
+	daulog.Infof("transformed %s", s.uploadSourceFilename())
+	s.TransformedFilename = transformed
+	return nil
+}
+
+// trimmed shrinks the rectangle to remove rows and columns at its edges
+// which are all the colour of that edge's outermost corner. If the whole
+// image is one colour it is left alone.
+func trimmed(im i.Image, r i.Rectangle) i.Rectangle {
+	// uniform checks every pixel in the area is the colour of the border
+	uniform := func(ref i.Point, x0, y0, x1, y1 int) bool {
+		rr, rg, rb, _ := im.At(ref.X, ref.Y).RGBA()
+		for y := y0; y < y1; y++ {
+			for x := x0; x < x1; x++ {
+				cr, cg, cb, _ := im.At(x, y).RGBA()
+				if absDiff(cr, rr) > trimTolerance<<8 || absDiff(cg, rg) > trimTolerance<<8 || absDiff(cb, rb) > trimTolerance<<8 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+
+	t := r
+	ref := r.Min
+	for t.Dy() > 1 && uniform(ref, t.Min.X, t.Min.Y, t.Max.X, t.Min.Y+1) {
+		t.Min.Y++
+	}
+	ref = i.Pt(r.Min.X, r.Max.Y-1)
+	for t.Dy() > 1 && uniform(ref, t.Min.X, t.Max.Y-1, t.Max.X, t.Max.Y) {
+		t.Max.Y--
+	}
+	ref = r.Min
+	for t.Dx() > 1 && uniform(ref, t.Min.X, t.Min.Y, t.Min.X+1, t.Max.Y) {
+		t.Min.X++
+	}
+	ref = i.Pt(r.Max.X-1, r.Min.Y)
+	for t.Dx() > 1 && uniform(ref, t.Max.X-1, t.Min.Y, t.Max.X, t.Max.Y) {
+		t.Max.X--
+	}
+	if t.Dx() <= 1 || t.Dy() <= 1 {
+		return r
+	}
+	return t
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// aspectCrop returns the largest rectangle of the given shape in the middle
+// of r.
+func aspectCrop(r i.Rectangle, ratio float64) i.Rectangle {
+	w, h := r.Dx(), r.Dy()
+	if float64(w)/float64(h) > ratio {
+		nw := maxInt(1, int(math.Round(float64(h)*ratio)))
+		x := r.Min.X + (w-nw)/2
+		return i.Rect(x, r.Min.Y, x+nw, r.Max.Y)
+	}
+	nh := maxInt(1, int(math.Round(float64(w)/ratio)))
+	y := r.Min.Y + (h-nh)/2
+	return i.Rect(r.Min.X, y, r.Max.X, y+nh)
+}
@@ -0,0 +1,175 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+// bordered returns a white image with a black border of the given width
+// and a red pixel in the top left of the white area.
+func bordered(width, height, border int) *i.RGBA {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < border || y < border || x >= width-border || y >= height-border {
+				im.Set(x, y, color.Black)
+			} else {
+				im.Set(x, y, color.White)
+			}
+		}
+	}
+	im.Set(border, border, color.RGBA{255, 0, 0, 255})
+	return im
+}
+
+func TestTransformValidate(t *testing.T) {
+	good := Transform{CropX: 0.25, CropY: 0, CropWidth: 0.5, CropHeight: 1, AspectRatio: "4:3", Rotate: 270, MaxDimension: 100}
+	if err := good.Validate(); err != nil {
+		t.Errorf("transform should be valid: %s", err)
+	}
+	bad := []Transform{
+		{CropX: 0.6, CropWidth: 0.5, CropHeight: 0.5},
+		{CropHeight: 0.5},
+		{AspectRatio: "16x9"},
+		{AspectRatio: "0:1"},
+		{Rotate: 45},
+		{MaxDimension: -10},
+	}
+	for _, tr := range bad {
+		if err := tr.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", tr)
+		}
+	}
+}
+
+func TestTransformCropAndAspect(t *testing.T) {
+	im := bordered(200, 100, 0)
+	out := Transform{CropX: 0.5, CropY: 0, CropWidth: 0.5, CropHeight: 1}.apply(im)
+	if b := out.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Errorf("wrong cropped size %v", b)
+	}
+	out = Transform{AspectRatio: "1:1"}.apply(im)
+	if b := out.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Errorf("wrong size for 1:1, %v", b)
+	}
+	out = Transform{AspectRatio: "4:1"}.apply(im)
+	if b := out.Bounds(); b.Dx() != 200 || b.Dy() != 50 {
+		t.Errorf("wrong size for 4:1, %v", b)
+	}
+}
+
+func TestTransformTrim(t *testing.T) {
+	out := Transform{TrimBorders: true}.apply(bordered(100, 80, 10))
+	if b := out.Bounds(); b.Dx() != 80 || b.Dy() != 60 {
+		t.Errorf("border not trimmed, %v", b)
+	}
+	if r, g, _, _ := out.At(0, 0).RGBA(); r != 0xffff || g != 0 {
+		t.Error("trimmed the wrong part of the image")
+	}
+
+	// an image of a single colour is left alone
+	out = Transform{TrimBorders: true}.apply(white(50, 50))
+	if b := out.Bounds(); b.Dx() != 50 || b.Dy() != 50 {
+		t.Errorf("plain image was trimmed, %v", b)
+	}
+}
+
+func TestTransformRotateFlip(t *testing.T) {
+	im := bordered(40, 20, 0) // red pixel at 0,0
+	red := func(out i.Image, x, y int) bool {
+		r, g, _, _ := out.At(x, y).RGBA()
+		return r == 0xffff && g == 0
+	}
+
+	out := Transform{Rotate: 90}.apply(im)
+	if b := out.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Errorf("wrong size after rotation, %v", b)
+	}
+	if !red(out, 19, 0) {
+		t.Error("rotated 90 the wrong way")
+	}
+	if out = (Transform{Rotate: 180}).apply(im); !red(out, 39, 19) {
+		t.Error("not rotated 180")
+	}
+	if out = (Transform{Rotate: 270}).apply(im); !red(out, 0, 39) {
+		t.Error("rotated 270 the wrong way")
+	}
+	if out = (Transform{FlipH: true}).apply(im); !red(out, 39, 0) {
+		t.Error("not flipped horizontally")
+	}
+	if out = (Transform{FlipV: true}).apply(im); !red(out, 0, 19) {
+		t.Error("not flipped vertically")
+	}
+}
+
+func TestTransformMaxDimension(t *testing.T) {
+	out := Transform{MaxDimension: 50}.apply(white(200, 100))
+	if b := out.Bounds(); b.Dx() != 50 || b.Dy() != 25 {
+		t.Errorf("wrong scaled size %v", b)
+	}
+	out = Transform{MaxDimension: 500}.apply(white(200, 100))
+	if b := out.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Errorf("small image was scaled, %v", b)
+	}
+}
+
+func TestTransformUpload(t *testing.T) {
+	f, err := os.CreateTemp("", "dautest-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, bordered(300, 200, 20))
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := Store{
+		OriginalFilename: f.Name(),
+		MaxBytes:         8_000_000,
+		Transform:        Transform{TrimBorders: true, Rotate: 90},
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+	if s.TransformedFilename == "" {
+		t.Fatal("no transformed file")
+	}
+	im, _, _, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := im.Bounds(); b.Dx() != 160 || b.Dy() != 260 {
+		t.Errorf("wrong size after transform, %v", b)
+	}
+}
+
+func TestTransformGIF(t *testing.T) {
+	f := tempGIF(t, 100, 60, 3, false)
+	defer os.Remove(f)
+
+	s := Store{
+		OriginalFilename: f,
+		MaxBytes:         8_000_000,
+		Transform:        Transform{Rotate: 90, MaxDimension: 50},
+	}
+	if err := s.Prepare(); err != nil {
+		t.Fatalf("could not prepare: %s", err)
+	}
+	defer s.Cleanup()
+
+	g := decodeGIF(t, s.uploadSourceFilename())
+	if len(g.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(g.Image))
+	}
+	if g.Config.Width != 30 || g.Config.Height != 50 {
+		t.Errorf("wrong size %dx%d", g.Config.Width, g.Config.Height)
+	}
+	for n, frame := range g.Image {
+		if b := frame.Bounds(); b.Dx() != 30 || b.Dy() != 50 {
+			t.Errorf("frame %d is the wrong size, %v", n, b)
+		}
+	}
+}
@@ -3,46 +3,143 @@ package image
 import (
 	"fmt"
 	i "image"
+	"image/color"
 	"image/jpeg"
 	"image/png"
+	"math"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	daulog "github.com/tardisx/discord-auto-upload/log"
 
 	"github.com/fogleman/gg"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomono"
 	"golang.org/x/image/font/inconsolata"
+	"golang.org/x/image/font/opentype"
 )
 
-// applyWatermark applies the watermark to the image
-func (s *Store) applyWatermark() error {
+// DefaultWatermarkText is the text of the watermark if none is configured.
+const DefaultWatermarkText = "github.com/tardisx/discord-auto-upload"
 
-	in, err := os.Open(s.uploadSourceFilename())
+// WatermarkOptions control how the watermark looks. The zero value gives
+// the project's own watermark, small white text on a black bar in the
+// bottom left corner.
+type WatermarkOptions struct {
+	Text       string  // may contain the same placeholders as FilenameTemplate
+	Position   string  // a corner like top-left, an edge like bottom, or center. bottom-left if empty
+	Scale      float64 // height of the text as a fraction of the shorter side of the image, 0 for small text of a fixed size
+	Foreground string  // colour of the text, as #rrggbb or #rrggbbaa
+	Background string  // colour of the bar behind the text
+	Logo       string  // optional PNG file, drawn before the text
+}
 
-	defer in.Close()
+var (
+	monoFontOnce sync.Once
+	monoFont     *opentype.Font
+	monoFontErr  error
+)
 
-	im, _, err := i.Decode(in)
-	if err != nil {
-		daulog.Errorf("Cannot decode image: %v - skipping watermarking", err)
-		return fmt.Errorf("cannot decode image: %w", err)
-	}
-	bounds := im.Bounds()
-	// var S float64 = float64(bounds.Max.X)
+// watermark is a watermark ready to be drawn on images.
+type watermark struct {
+	text       string
+	position   string
+	scale      float64
+	foreground color.Color
+	background color.Color
+	logo       i.Image
 
-	dc := gg.NewContext(bounds.Max.X, bounds.Max.Y)
-	dc.Clear()
-	dc.SetRGB(0, 0, 0)
+	// faces are kept for each size, so each frame of an animation does
+	// not need the glyphs to be drawn again. They are released by close.
+	faces map[float64]font.Face
+}
 
-	dc.SetFontFace(inconsolata.Regular8x16)
+// watermark prepares the store's watermark for drawing.
+func (s *Store) watermark() (*watermark, error) {
+	o := s.WatermarkOptions
+	wm := &watermark{
+		text:       DefaultWatermarkText,
+		position:   "bottom-left",
+		scale:      o.Scale,
+		foreground: color.White,
+		background: color.Black,
+	}
+	if o.Text != "" {
+		wm.text = s.expandTemplate(o.Text)
+	}
+	if o.Position != "" {
+		wm.position = o.Position
+	}
+	var err error
+	if o.Foreground != "" {
+		wm.foreground, err = parseColour(o.Foreground)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Background != "" {
+		wm.background, err = parseColour(o.Background)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.Logo != "" {
+		f, err := os.Open(o.Logo)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open watermark logo: %s", err)
+		}
+		defer f.Close()
+		wm.logo, err = png.Decode(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode watermark logo: %s", err)
+		}
+	}
+	return wm, nil
+}
 
-	dc.DrawImage(im, 0, 0)
+// parseColour parses a colour written as #rrggbb, or #rrggbbaa to include
+// the opacity.
+func parseColour(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) != 6 && len(hex) != 8 || hex == s {
+		return nil, fmt.Errorf("colour '%s' should look like #rrggbb or #rrggbbaa", s)
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("colour '%s' should look like #rrggbb or #rrggbbaa", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
 
-	dc.DrawRoundedRectangle(0, float64(bounds.Max.Y-18.0), 320, float64(bounds.Max.Y), 0)
-	dc.SetRGB(0, 0, 0)
-	dc.Fill()
+// applyWatermark applies the watermark to the image
+func (s *Store) applyWatermark() error {
+	wm, err := s.watermark()
+	if err != nil {
+		return err
+	}
+	defer wm.close()
 
-	dc.SetRGB(1, 1, 1)
+	if s.OriginalFormat == "gif" {
+		// every frame needs the watermark
+		watermarked, err := rewriteGIF(s.uploadSourceFilename(), gifOptions{scale: 1, frameStep: 1, colours: 256, watermark: wm})
+		if err != nil {
+			return err
+		}
+		s.WatermarkedFilename = watermarked
+		return nil
+	}
 
-	dc.DrawString("github.com/tardisx/discord-auto-upload", 5.0, float64(bounds.Max.Y)-5.0)
+	im, _, _, err := decodeFile(s.uploadSourceFilename())
+	if err != nil {
+		daulog.Errorf("Cannot decode image: %v - skipping watermarking", err)
+		return fmt.Errorf("cannot decode image: %w", err)
+	}
 
 	waterMarkedFile, err := os.CreateTemp("", "dau_watermark_file_*")
 
@@ -52,13 +149,118 @@ func (s *Store) applyWatermark() error {
 	defer waterMarkedFile.Close()
 
 	if s.OriginalFormat == "png" {
-		png.Encode(waterMarkedFile, dc.Image())
+		err = png.Encode(waterMarkedFile, wm.draw(im))
 	} else if s.OriginalFormat == "jpeg" {
-		jpeg.Encode(waterMarkedFile, dc.Image(), nil)
+		err = jpeg.Encode(waterMarkedFile, wm.draw(im), nil)
 	} else {
-		panic("Cannot handle " + s.OriginalFormat)
+		err = fmt.Errorf("cannot watermark format %s", s.OriginalFormat)
+	}
+	if err != nil {
+		os.Remove(waterMarkedFile.Name())
+		return err
 	}
 
 	s.WatermarkedFilename = waterMarkedFile.Name()
 	return nil
 }
+
+// face returns the font for an image of the given size.
+func (wm *watermark) face(width, height int) font.Face {
+	if wm.scale <= 0 {
+		return inconsolata.Regular8x16
+	}
+	size := math.Max(8, wm.scale*float64(minInt(width, height)))
+	if face, ok := wm.faces[size]; ok {
+		return face
+	}
+	monoFontOnce.Do(func() {
+		monoFont, monoFontErr = opentype.Parse(gomono.TTF)
+	})
+	err := monoFontErr
+	if err == nil {
+		var face font.Face
+		face, err = opentype.NewFace(monoFont, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err == nil {
+			if wm.faces == nil {
+				wm.faces = map[float64]font.Face{}
+			}
+			wm.faces[size] = face
+			return face
+		}
+	}
+	daulog.Errorf("cannot load watermark font: %s", err)
+	return inconsolata.Regular8x16
+}
+
+// close releases the fonts of the watermark, once it has been drawn.
+func (wm *watermark) close() {
+	for size, face := range wm.faces {
+		face.Close()
+		delete(wm.faces, size)
+	}
+}
+
+// draw returns a copy of the image with the watermark: the logo and text
+// on a bar at the chosen position.
+func (wm *watermark) draw(im i.Image) i.Image {
+	bounds := im.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	dc := gg.NewContext(width, height)
+	dc.Clear()
+	dc.DrawImage(im, -bounds.Min.X, -bounds.Min.Y)
+
+	face := wm.face(width, height)
+	dc.SetFontFace(face)
+	metrics := face.Metrics()
+	textHeight := float64(metrics.Height.Ceil())
+	textWidth, _ := dc.MeasureString(wm.text)
+	pad := math.Max(2, math.Round(textHeight/4))
+
+	var logo i.Image
+	logoWidth := 0.0
+	if wm.logo != nil {
+		lb := wm.logo.Bounds()
+		lh := int(textHeight)
+		lw := int(math.Max(1, math.Round(float64(lb.Dx())*textHeight/float64(lb.Dy()))))
+		scaled := i.NewRGBA(i.Rect(0, 0, lw, lh))
+		draw.CatmullRom.Scale(scaled, scaled.Rect, wm.logo, lb, draw.Src, nil)
+		logo = scaled
+		logoWidth = float64(lw) + pad
+	}
+
+	barWidth := pad + logoWidth + textWidth + pad
+	barHeight := textHeight + pad
+	x, y := 0.0, 0.0
+	switch {
+	case strings.HasSuffix(wm.position, "right"):
+		x = float64(width) - barWidth
+	case !strings.HasSuffix(wm.position, "left"):
+		x = math.Round((float64(width) - barWidth) / 2)
+	}
+	switch {
+	case strings.HasPrefix(wm.position, "bottom"):
+		y = float64(height) - barHeight
+	case !strings.HasPrefix(wm.position, "top"):
+		y = math.Round((float64(height) - barHeight) / 2)
+	}
+
+	dc.SetColor(wm.background)
+	dc.DrawRectangle(x, y, barWidth, barHeight)
+	dc.Fill()
+
+	if logo != nil {
+		dc.DrawImage(logo, int(x+pad), int(y+pad/2))
+	}
+	dc.SetColor(wm.foreground)
+	dc.DrawString(wm.text, x+pad+logoWidth, y+pad/2+float64(metrics.Ascent.Ceil()))
+
+	return dc.Image()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,128 @@
+package image
+
+import (
+	i "image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+)
+
+func TestParseColour(t *testing.T) {
+	c, err := parseColour("#ff8000")
+	if err != nil || c != (color.NRGBA{255, 128, 0, 255}) {
+		t.Errorf("wrong colour %v: %v", c, err)
+	}
+	c, err = parseColour("#00000080")
+	if err != nil || c != (color.NRGBA{0, 0, 0, 128}) {
+		t.Errorf("wrong colour %v: %v", c, err)
+	}
+	for _, bad := range []string{"ff8000", "#ff80", "#gg8000", ""} {
+		if _, err := parseColour(bad); err == nil {
+			t.Errorf("colour '%s' should not parse", bad)
+		}
+	}
+}
+
+func white(width, height int) i.Image {
+	im := i.NewRGBA(i.Rect(0, 0, width, height))
+	for p := range im.Pix {
+		im.Pix[p] = 255
+	}
+	return im
+}
+
+func TestDefaultWatermark(t *testing.T) {
+	s := Store{}
+	wm, err := s.watermark()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := wm.draw(white(400, 100))
+	if r, g, b, _ := im.At(0, 99).RGBA(); r+g+b != 0 {
+		t.Error("no black bar in the bottom left")
+	}
+	if r, _, _, _ := im.At(399, 99).RGBA(); r != 0xffff {
+		t.Error("watermark is too wide")
+	}
+	if r, _, _, _ := im.At(0, 0).RGBA(); r != 0xffff {
+		t.Error("watermark is too tall")
+	}
+}
+
+func TestCustomWatermark(t *testing.T) {
+	logo := i.NewRGBA(i.Rect(0, 0, 10, 10))
+	for p := 0; p < len(logo.Pix); p += 4 {
+		logo.Pix[p], logo.Pix[p+3] = 255, 255 // red
+	}
+	f, err := os.CreateTemp("", "dautest-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, logo)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	s := Store{WatermarkOptions: WatermarkOptions{
+		Text:       "shot",
+		Position:   "top-right",
+		Scale:      0.1,
+		Foreground: "#ffffff",
+		Background: "#0000ff80",
+		Logo:       f.Name(),
+	}}
+	wm, err := s.watermark()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := wm.draw(white(1000, 800))
+
+	// half transparent blue over white, in the top right corner
+	r, g, b, _ := im.At(999, 0).RGBA()
+	if b != 0xffff || r < 0x7000 || r > 0x9000 || g != r {
+		t.Errorf("wrong background colour %x %x %x", r, g, b)
+	}
+	if r, _, _, _ := im.At(0, 799).RGBA(); r != 0xffff {
+		t.Error("watermark drawn in the wrong place")
+	}
+	// the text is about 80 pixels high, so the bar goes further down than
+	// the default watermark would
+	if _, _, b, _ := im.At(999, 70).RGBA(); b != 0xffff {
+		t.Error("watermark was not scaled")
+	}
+	// the logo is before the text
+	found := false
+	for x := 500; x < 1000 && !found; x++ {
+		r, g, _, _ := im.At(x, 40).RGBA()
+		found = r > 0xf000 && g < 0x1000
+	}
+	if !found {
+		t.Error("logo was not drawn")
+	}
+}
+
+func TestWatermarkErrors(t *testing.T) {
+	s := Store{WatermarkOptions: WatermarkOptions{Foreground: "red"}}
+	if _, err := s.watermark(); err == nil {
+		t.Error("bad colour should be an error")
+	}
+	s = Store{WatermarkOptions: WatermarkOptions{Logo: "/does/not/exist.png"}}
+	if _, err := s.watermark(); err == nil {
+		t.Error("missing logo should be an error")
+	}
+}
+
+func TestWatermarkFaceCached(t *testing.T) {
+	wm := &watermark{scale: 0.1}
+	if wm.face(100, 80) != wm.face(100, 80) {
+		t.Error("face for the same size was not reused")
+	}
+	wm.face(200, 160)
+	if len(wm.faces) != 2 {
+		t.Errorf("expected a face for each size, got %d", len(wm.faces))
+	}
+	wm.close()
+	if len(wm.faces) != 0 {
+		t.Error("faces were not released")
+	}
+}
@@ -0,0 +1,185 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/image"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// AddFiles adds the files a watcher found at the same time. If the watcher
+// makes collages and there are enough files, a contact sheet of them is
+// added first, and the files themselves are skipped if the collage is to be
+// posted instead of them.
+func (u *Uploader) AddFiles(files []string, conf config.Watcher) {
+	policy := conf.Collage.WithDefaults()
+	if policy.Mode == "" || len(files) < policy.MinImages {
+		for _, f := range files {
+			u.AddFile(f, conf)
+		}
+		return
+	}
+
+	ups := make([]*Upload, 0, len(files))
+	for _, f := range files {
+		ups = append(ups, u.newUpload(f, conf))
+	}
+
+	// near duplicates are skipped or held as usual, so they are left out
+	// of the collage
+	u.Lock.Lock()
+	included := make([]*Upload, 0, len(ups))
+	for _, up := range ups {
+		up.Id = atomic.AddInt32(&currentId, 1)
+		if _, _, found := u.checkDuplicate(up); !found {
+			included = append(included, up)
+		}
+	}
+	u.Lock.Unlock()
+
+	skipReason := ""
+	if len(included) < policy.MinImages {
+		daulog.Infof("not enough files from %s for a collage once near duplicates are left out", conf.Path)
+	} else {
+		opts := image.CollageOptions{Columns: policy.Columns, CellSize: policy.CellSize, Captions: policy.Captions}
+		collage, err := u.collageUpload(included, opts)
+		if err != nil {
+			// better to post them one by one than not at all
+			daulog.Errorf("could not make a collage of %d files from %s: %s", len(included), conf.Path, err)
+		} else {
+			u.add(collage, conf, "")
+			if policy.Mode == "instead" {
+				skipReason = fmt.Sprintf("posted in collage upload %d", collage.Id)
+			}
+		}
+	}
+	for _, up := range ups {
+		if up.duplicates.found {
+			// skipped or held as a duplicate, not posted in the collage
+			u.add(up, conf, "")
+		} else {
+			u.add(up, conf, skipReason)
+		}
+	}
+}
+
+// CollagePending makes a collage of pending uploads, which is queued
+// straight away. If instead is true the uploads are skipped, otherwise they
+// are queued to be posted after the collage.
+func (u *Uploader) CollagePending(ids []int32, opts image.CollageOptions, instead bool) (*Upload, error) {
+	if len(ids) < 2 {
+		return nil, errors.New("a collage needs at least 2 uploads")
+	}
+	ups := make([]*Upload, 0, len(ids))
+	for _, id := range ids {
+		up := u.UploadById(id)
+		if up == nil {
+			return nil, fmt.Errorf("no upload with id %d", id)
+		}
+		if state, _ := up.CurrentState(); state != StatePending {
+			return nil, fmt.Errorf("upload %d is not pending", id)
+		}
+		ups = append(ups, up)
+	}
+
+	// drawing the collage is slow, so the lock is not held
+	collage, err := u.collageUpload(ups, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Lock.Lock()
+	collage.Id = atomic.AddInt32(&currentId, 1)
+	// it goes in the list before the first of the uploads, so it is sent
+	// before any of them
+	at := len(u.Uploads)
+	for n, existing := range u.Uploads {
+		for _, up := range ups {
+			if existing == up && n < at {
+				at = n
+			}
+		}
+	}
+	u.Uploads = append(u.Uploads[:at], append([]*Upload{collage}, u.Uploads[at:]...)...)
+	collage.transition(StateQueued, "")
+	u.Lock.Unlock()
+
+	reason := fmt.Sprintf("posted in collage upload %d", collage.Id)
+	for _, up := range ups {
+		if instead {
+			err = up.skip(reason)
+		} else {
+			err = up.Start()
+		}
+		if err != nil {
+			// it was changed while the collage was drawn
+			daulog.Errorf("upload of %s: %s", up.Image.OriginalFilename, err)
+		}
+	}
+	return collage, nil
+}
+
+// collageUpload creates an upload of a contact sheet of the uploads. It is
+// sent to the same webhooks as the first of them, with the same settings.
+// It is not yet in the list of uploads.
+func (u *Uploader) collageUpload(ups []*Upload, opts image.CollageOptions) (*Upload, error) {
+	if len(ups) == 0 {
+		return nil, errors.New("no images for the collage")
+	}
+	// copies of the stores, as held uploads may be edited meanwhile
+	stores := make([]*image.Store, 0, len(ups))
+	files := make([]string, 0, len(ups))
+	for _, up := range ups {
+		s := up.ImageSnapshot()
+		stores = append(stores, &s)
+		files = append(files, s.OriginalFilename)
+	}
+
+	first := ups[0]
+	filename, err := image.Collage(stores, opts, int64(stores[0].MaxBytes))
+	if err != nil {
+		return nil, err
+	}
+	daulog.Infof("made a collage of %d images in %s", len(ups), filename)
+
+	store := &image.Store{
+		OriginalFilename: filename,
+		Generated:        true,
+		Watermark:        stores[0].Watermark,
+		WatermarkOptions: stores[0].WatermarkOptions,
+		MaxBytes:         stores[0].MaxBytes,
+		FilenameTemplate: stores[0].FilenameTemplate,
+		Spoiler:          stores[0].Spoiler,
+		Metadata:         stores[0].Metadata,
+	}
+
+	first.stateLock.Lock()
+	dests := make([]*Destination, 0, len(first.Destinations))
+	for _, d := range first.Destinations {
+		dests = append(dests, &Destination{Name: d.Name, webhookURL: d.webhookURL, State: StateQueued})
+	}
+	first.stateLock.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Upload{
+		AddedAt:      time.Now(),
+		Watcher:      first.Watcher,
+		Image:        store,
+		payload:      first.payload,
+		retryPolicy:  first.retryPolicy,
+		limiters:     first.limiters,
+		Rule:         first.Rule,
+		Destinations: dests,
+		Collage:      files,
+		DryRun:       first.DryRun,
+		Client:       first.Client,
+		events:       u.events,
+		ctx:          ctx,
+		cancel:       cancel,
+	}, nil
+}
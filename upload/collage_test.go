@@ -0,0 +1,176 @@
+package upload
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/image"
+)
+
+func tempFiles(t *testing.T, n int) []string {
+	files := []string{}
+	for f := 0; f < n; f++ {
+		files = append(files, tempScene(t, f*10))
+	}
+	return files
+}
+
+func TestAddFilesCollage(t *testing.T) {
+	files := tempFiles(t, 3)
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	for _, mode := range []string{"before", "instead"} {
+		u := NewUploader()
+		conf := config.Watcher{Path: "/shots", WebHookURL: "https://127.0.0.1/", Collage: config.CollagePolicy{Mode: mode, MinImages: 3}}
+		u.AddFiles(files, conf)
+		if len(u.Uploads) != 4 {
+			t.Fatalf("%s: expected a collage and 3 uploads, got %d", mode, len(u.Uploads))
+		}
+		collage := u.Uploads[0]
+		defer os.Remove(collage.Image.OriginalFilename)
+		if len(collage.Collage) != 3 || !collage.Image.Generated || collage.State != StateQueued {
+			t.Errorf("%s: first upload should be the queued collage", mode)
+		}
+		if len(collage.Destinations) != 1 || collage.Destinations[0].webhookURL != "https://127.0.0.1/" {
+			t.Errorf("%s: collage is not going to the watcher's webhook", mode)
+		}
+		want := StateQueued
+		if mode == "instead" {
+			want = StateSkipped
+		}
+		for _, up := range u.Uploads[1:] {
+			if up.State != want {
+				t.Errorf("%s: image should be %s, got %s", mode, want, up.State)
+			}
+		}
+	}
+
+	// too few images for a collage
+	u := NewUploader()
+	u.AddFiles(files[:2], config.Watcher{Path: "/shots", Collage: config.CollagePolicy{Mode: "instead", MinImages: 3}})
+	if len(u.Uploads) != 2 || u.Uploads[0].Collage != nil {
+		t.Error("collage made from too few images")
+	}
+}
+
+func TestAddFilesCollageDuplicates(t *testing.T) {
+	files := []string{tempScene(t, 0), tempScene(t, 60), tempScene(t, 0), tempScene(t, 120)}
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	for _, action := range []string{"skip", "hold"} {
+		u := NewUploader()
+		conf := config.Watcher{
+			Path:       "/shots",
+			WebHookURL: "https://127.0.0.1/",
+			Collage:    config.CollagePolicy{Mode: "instead", MinImages: 3},
+			Duplicates: config.DuplicatePolicy{Action: action, Threshold: 4},
+		}
+		u.AddFiles(files, conf)
+		if len(u.Uploads) != 5 {
+			t.Fatalf("%s: expected a collage and 4 uploads, got %d", action, len(u.Uploads))
+		}
+		collage := u.Uploads[0]
+		defer os.Remove(collage.Image.OriginalFilename)
+		if len(collage.Collage) != 3 {
+			t.Errorf("%s: collage should leave out the duplicate, has %v", action, collage.Collage)
+		}
+		for _, f := range collage.Collage {
+			if f == files[2] {
+				t.Errorf("%s: duplicate is in the collage", action)
+			}
+		}
+
+		dup := u.Uploads[3]
+		want := StateSkipped
+		if action == "hold" {
+			want = StatePending
+		}
+		if dup.State != want || dup.Duplicate == nil || !strings.Contains(dup.StateReason, "looks like") {
+			t.Errorf("%s: duplicate should be %s as a duplicate, got %s: %s", action, want, dup.State, dup.StateReason)
+		}
+		for _, n := range []int{1, 2, 4} {
+			if !strings.Contains(u.Uploads[n].StateReason, "collage") {
+				t.Errorf("%s: upload %d should be posted in the collage, got %s", action, n, u.Uploads[n].StateReason)
+			}
+		}
+	}
+}
+
+func TestCollagePending(t *testing.T) {
+	files := tempFiles(t, 3)
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	u := NewUploader()
+	conf := config.Watcher{Path: "/shots", WebHookURL: "https://127.0.0.1/", HoldUploads: true}
+	u.AddFiles(files, conf)
+	ids := []int32{u.Uploads[1].Id, u.Uploads[2].Id}
+
+	if _, err := u.CollagePending(ids[:1], image.CollageOptions{}, true); err == nil {
+		t.Error("collage of one upload should be an error")
+	}
+	collage, err := u.CollagePending(ids, image.CollageOptions{Captions: true}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(collage.Image.OriginalFilename)
+
+	// the collage goes before the uploads it was made from
+	if len(u.Uploads) != 4 || u.Uploads[1] != collage || collage.State != StateQueued {
+		t.Fatalf("collage is not queued in the right place")
+	}
+	if u.Uploads[0].State != StatePending {
+		t.Error("upload not in the collage should still be pending")
+	}
+	for _, up := range u.Uploads[2:] {
+		if up.State != StateQueued {
+			t.Errorf("upload in the collage should be queued, got %s", up.State)
+		}
+	}
+
+	if _, err := u.CollagePending(ids, image.CollageOptions{}, true); err == nil {
+		t.Error("uploads which are no longer pending should be an error")
+	}
+
+	if _, err := u.CollagePending([]int32{u.Uploads[0].Id, collage.Id}, image.CollageOptions{}, true); err == nil {
+		t.Error("queued collage should not be put in another collage")
+	}
+}
+
+func TestCollagePendingInstead(t *testing.T) {
+	files := tempFiles(t, 2)
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+
+	u := NewUploader()
+	u.AddFiles(files, config.Watcher{Path: "/shots", WebHookURL: "https://127.0.0.1/", HoldUploads: true})
+	collage, err := u.CollagePending([]int32{u.Uploads[0].Id, u.Uploads[1].Id}, image.CollageOptions{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(collage.Image.OriginalFilename)
+	if u.Uploads[0] != collage {
+		t.Fatal("collage should be first")
+	}
+	for _, up := range u.Uploads[1:] {
+		if up.State != StateSkipped || up.StateReason == "" {
+			t.Errorf("upload should be skipped with a reason, got %s", up.State)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	i "image"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+var dryRunCount int32
+
+// dryRunClient is used in place of the HTTP client in dry-run mode. Instead
+// of sending the request to discord, the file and a description of the
+// request are written to a directory, and a successful response is faked.
+type dryRunClient struct {
+	dir string
+}
+
+// dryRunRequest describes the request that would have been sent.
+type dryRunRequest struct {
+	Time        time.Time       `json:"time"`
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	ContentType string          `json:"content_type"`
+	Payload     json.RawMessage `json:"payload_json,omitempty"`
+	Filename    string          `json:"filename"`
+	Size        int             `json:"size"`
+	SavedAs     string          `json:"saved_as"`
+}
+
+// DefaultDryRunDir is where dry-run uploads are written if no directory is
+// configured.
+func DefaultDryRunDir() string {
+	return filepath.Join(os.TempDir(), "dau-dry-run")
+}
+
+func newDryRunClient(dir string) *dryRunClient {
+	if dir == "" {
+		dir = DefaultDryRunDir()
+	}
+	return &dryRunClient{dir: dir}
+}
+
+func (c *dryRunClient) Do(req *http.Request) (*http.Response, error) {
+	// read the body, so rate limits and progress work as they would
+	// for a real upload
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	err = req.ParseMultipartForm(32 << 20)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse request: %s", err)
+	}
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		return nil, fmt.Errorf("no file in request: %s", err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(c.dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create dry-run directory: %s", err)
+	}
+
+	prefix := fmt.Sprintf("%s-%d-", time.Now().Format("20060102-150405"), atomic.AddInt32(&dryRunCount, 1))
+	imageFile := filepath.Join(c.dir, prefix+filepath.Base(header.Filename))
+	err = ioutil.WriteFile(imageFile, data, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not write dry-run file: %s", err)
+	}
+
+	desc := dryRunRequest{
+		Time:        time.Now(),
+		Method:      req.Method,
+		URL:         redactWebhook(req.URL.String()),
+		ContentType: req.Header.Get("Content-Type"),
+		Filename:    header.Filename,
+		Size:        len(data),
+		SavedAs:     imageFile,
+	}
+	if p := req.FormValue("payload_json"); p != "" {
+		desc.Payload = json.RawMessage(p)
+	}
+	descJSON, _ := json.MarshalIndent(desc, "", "  ")
+	err = ioutil.WriteFile(imageFile+".json", descJSON, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not write dry-run description: %s", err)
+	}
+	daulog.Infof("Dry run: wrote %s instead of uploading", imageFile)
+
+	width, height := 0, 0
+	if conf, _, err := i.DecodeConfig(bytes.NewReader(data)); err == nil {
+		width, height = conf.Width, conf.Height
+	}
+
+	fileURL := "file://" + filepath.ToSlash(imageFile)
+	res, _ := json.Marshal(map[string]interface{}{
+		"id": "0",
+		"attachments": []map[string]interface{}{
+			{"url": fileURL, "proxy_url": fileURL, "size": len(data), "width": width, "height": height, "filename": header.Filename},
+		},
+	})
+	return &http.Response{
+		StatusCode: 200,
+		Body:       ioutil.NopCloser(bytes.NewReader(res)),
+	}, nil
+}
+
+// redactWebhook removes the secret token from a webhook URL, leaving the id.
+func redactWebhook(url string) string {
+	idx := strings.Index(url, "/webhooks/")
+	if idx < 0 {
+		return url
+	}
+	rest := url[idx+len("/webhooks/"):]
+	if slash := strings.Index(rest, "/"); slash >= 0 {
+		return url[:idx+len("/webhooks/")+slash] + "/REDACTED"
+	}
+	return url
+}
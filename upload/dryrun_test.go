@@ -0,0 +1,54 @@
+package upload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+func TestDryRun(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+	dir, err := ioutil.TempDir("", "dautest-dryrun-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	up := NewUploader()
+	up.ApplyConfig(&config.ConfigV3{DryRun: true, DryRunDir: dir})
+	up.AddFile(f, config.Watcher{WebHookURL: "https://discord.com/api/webhooks/1234/secret", Username: "me", NoWatermark: true})
+	up.Upload()
+
+	u := up.Uploads[0]
+	if u.State != StateComplete {
+		t.Fatalf("dry run upload should be complete, is %s (%s)", u.State, u.StateReason)
+	}
+	if !u.DryRun || !strings.HasPrefix(u.Url, "file://") {
+		t.Errorf("not marked as a dry run: %v %s", u.DryRun, u.Url)
+	}
+
+	descs, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(descs) != 1 {
+		t.Fatalf("expected one description, got %v", descs)
+	}
+	b, _ := ioutil.ReadFile(descs[0])
+	desc := dryRunRequest{}
+	json.Unmarshal(b, &desc)
+	if desc.URL != "https://discord.com/api/webhooks/1234/REDACTED" {
+		t.Errorf("webhook token not redacted: %s", desc.URL)
+	}
+	payload := webhookPayload{}
+	json.Unmarshal(desc.Payload, &payload)
+	if payload.Username != "me" {
+		t.Errorf("payload not recorded: %s", desc.Payload)
+	}
+	if fi, err := os.Stat(desc.SavedAs); err != nil || fi.Size() != int64(desc.Size) {
+		t.Errorf("image not saved correctly: %v", err)
+	}
+}
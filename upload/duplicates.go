@@ -0,0 +1,103 @@
+package upload
+
+import (
+	"fmt"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/image"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// DuplicateOf describes the earlier upload that an image looks almost the
+// same as.
+type DuplicateOf struct {
+	Id       int32  `json:"id"`
+	Filename string `json:"filename"`
+	Distance int    `json:"distance"` // number of bits of the hashes which differ
+}
+
+// recentHash is the perceptual hash of an image found by a watcher.
+type recentHash struct {
+	id       int32
+	filename string
+	hash     uint64
+}
+
+// duplicateCheck is the result of hashing a new file, before it is added,
+// and of comparing it with the recent images once it has been.
+type duplicateCheck struct {
+	policy config.DuplicatePolicy
+	hash   uint64
+	hashed bool
+
+	checked bool
+	found   bool
+	state   State
+	reason  string
+}
+
+// hashForDuplicates hashes the file, if the watcher looks for duplicates.
+func hashForDuplicates(file string, conf config.Watcher) duplicateCheck {
+	check := duplicateCheck{policy: conf.Duplicates.WithDefaults()}
+	if check.policy.Action == "" {
+		return check
+	}
+	hash, err := image.DHash(file)
+	if err != nil {
+		daulog.Errorf("could not hash %s to look for duplicates: %s", file, err)
+		return check
+	}
+	check.hash, check.hashed = hash, true
+	return check
+}
+
+// checkDuplicate compares the new upload with the recent images from the
+// same watcher. If it is a near duplicate it returns the state the upload
+// should start in, and the reason. Otherwise the upload is remembered, for
+// comparing with later images. An upload is only compared once, later calls
+// return the same result. The lock must be held.
+func (u *Uploader) checkDuplicate(up *Upload) (State, string, bool) {
+	check := &up.duplicates
+	if !check.hashed {
+		return "", "", false
+	}
+	if !check.checked {
+		check.checked = true
+		check.state, check.reason, check.found = u.compareRecent(up, check)
+	}
+	return check.state, check.reason, check.found
+}
+
+// compareRecent does the work of checkDuplicate.
+func (u *Uploader) compareRecent(up *Upload, check *duplicateCheck) (State, string, bool) {
+	recent := u.recentHashes[up.Watcher]
+
+	var closest *recentHash
+	distance := 65
+	for n := range recent {
+		if d := image.HashDistance(check.hash, recent[n].hash); d < distance {
+			closest, distance = &recent[n], d
+		}
+	}
+	if closest != nil && distance <= check.policy.Threshold {
+		up.Duplicate = &DuplicateOf{Id: closest.id, Filename: closest.filename, Distance: distance}
+		reason := fmt.Sprintf("looks like %s, upload %d (%d bits different)", closest.filename, closest.id, distance)
+		daulog.Infof("%s %s", up.Image.OriginalFilename, reason)
+		if check.policy.Action == "skip" {
+			return StateSkipped, reason, true
+		}
+		return StatePending, reason, true
+	}
+
+	// near duplicates are not remembered, so a slowly changing scene is
+	// compared with the last image which was not skipped or held
+	if u.recentHashes == nil {
+		u.recentHashes = make(map[string][]recentHash)
+	}
+	recent = append(recent, recentHash{id: up.Id, filename: up.Image.OriginalFilename, hash: check.hash})
+	if len(recent) > check.policy.Recent {
+		recent = recent[len(recent)-check.policy.Recent:]
+	}
+	u.recentHashes[up.Watcher] = recent
+	return "", "", false
+}
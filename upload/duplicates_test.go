@@ -0,0 +1,92 @@
+package upload
+
+import (
+	i "image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+// tempScene writes a PNG of a light box on a dark background, which can be
+// moved to make a different image.
+func tempScene(t *testing.T, boxX int) string {
+	im := i.NewRGBA(i.Rect(0, 0, 160, 90))
+	for y := 0; y < 90; y++ {
+		for x := 0; x < 160; x++ {
+			c := color.RGBA{20, 20, 40, 255}
+			if x >= boxX && x < boxX+40 && y >= 20 && y < 70 {
+				c = color.RGBA{240, 220, 200, 255}
+			}
+			im.Set(x, y, c)
+		}
+	}
+	f, err := os.CreateTemp("", "dautest-scene-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	png.Encode(f, im)
+	return f.Name()
+}
+
+func TestDuplicates(t *testing.T) {
+	first := tempScene(t, 10)
+	same := tempScene(t, 10)
+	moved := tempScene(t, 100)
+	for _, f := range []string{first, same, moved} {
+		defer os.Remove(f)
+	}
+
+	for _, action := range []string{"skip", "hold"} {
+		u := NewUploader()
+		conf := config.Watcher{Path: "/shots", WebHookURL: "https://127.0.0.1/", Duplicates: config.DuplicatePolicy{Action: action, Threshold: 4}}
+		u.AddFile(first, conf)
+		u.AddFile(same, conf)
+		u.AddFile(moved, conf)
+
+		if u.Uploads[0].State != StateQueued || u.Uploads[0].Duplicate != nil {
+			t.Errorf("%s: first image should be queued", action)
+		}
+		dup := u.Uploads[1]
+		want := StateSkipped
+		if action == "hold" {
+			want = StatePending
+		}
+		if dup.State != want || dup.StateReason == "" {
+			t.Errorf("%s: duplicate should be %s with a reason, got %s", action, want, dup.State)
+		}
+		if dup.Duplicate == nil || dup.Duplicate.Id != u.Uploads[0].Id || dup.Duplicate.Filename != first {
+			t.Errorf("%s: duplicate does not point at the first upload, %+v", action, dup.Duplicate)
+		}
+		if u.Uploads[2].State != StateQueued {
+			t.Errorf("%s: different image should be queued, got %s", action, u.Uploads[2].State)
+		}
+	}
+}
+
+func TestDuplicatesPerWatcher(t *testing.T) {
+	f := tempScene(t, 10)
+	defer os.Remove(f)
+
+	u := NewUploader()
+	policy := config.DuplicatePolicy{Action: "skip", Threshold: 4}
+	u.AddFile(f, config.Watcher{Path: "/a", Duplicates: policy})
+	u.AddFile(f, config.Watcher{Path: "/b", Duplicates: policy})
+	u.AddFile(f, config.Watcher{Path: "/c"})
+	for _, up := range u.Uploads {
+		if up.State != StateQueued {
+			t.Errorf("upload from %s should not be a duplicate", up.Watcher)
+		}
+	}
+
+	// only the most recent images are compared
+	u.AddFile(tempScene(t, 60), config.Watcher{Path: "/a", Duplicates: config.DuplicatePolicy{Action: "skip", Recent: 1}})
+	u.AddFile(f, config.Watcher{Path: "/a", Duplicates: config.DuplicatePolicy{Action: "skip", Recent: 1}})
+	defer os.Remove(u.Uploads[3].Image.OriginalFilename)
+	if u.Uploads[4].State != StateQueued {
+		t.Error("image older than the recent ones should not be a duplicate")
+	}
+}
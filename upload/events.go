@@ -0,0 +1,71 @@
+package upload
+
+import (
+	"sync"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// eventBufferSize is how many events a subscriber may fall behind by before
+// events are dropped.
+const eventBufferSize = 100
+
+// Event is published whenever an upload changes state.
+type Event struct {
+	Upload   int32  `json:"upload"` // id of the upload
+	Filename string `json:"filename"`
+	Watcher  string `json:"watcher"`
+	Transition
+}
+
+type eventBus struct {
+	lock        sync.Mutex
+	subscribers map[int]chan Event
+	next        int
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[int]chan Event)}
+}
+
+// Subscribe returns a channel receiving every upload state change, and a
+// function to call to unsubscribe. Subscribers should read promptly, events
+// are dropped rather than holding up uploads.
+func (u *Uploader) Subscribe() (<-chan Event, func()) {
+	return u.events.subscribe()
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := b.next
+	b.next++
+	ch := make(chan Event, eventBufferSize)
+	b.subscribers[id] = ch
+
+	return ch, func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.subscribers[id]; ok {
+			delete(b.subscribers, id)
+			close(ch)
+		}
+	}
+}
+
+// publish sends an event to all subscribers. A nil bus, as used by uploads
+// created outside of an Uploader, discards events.
+func (b *eventBus) publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+			daulog.Errorf("dropping event for upload %d, subscriber is not keeping up", e.Upload)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+
+	"github.com/tardisx/discord-auto-upload/history"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// SetHistory sets where finished uploads are recorded. It may be nil, in
+// which case no history is kept.
+func (u *Uploader) SetHistory(h *history.Store) {
+	u.Lock.Lock()
+	defer u.Lock.Unlock()
+	u.history = h
+}
+
+// recordHistory writes each destination of the upload which has finished
+// since it was last recorded to the history. If evicted is true the upload
+// is being forgotten, so unfinished destinations are recorded too, with the
+// state of the upload as a whole.
+func (u *Uploader) recordHistory(up *Upload, evicted bool) {
+	u.Lock.Lock()
+	h := u.history
+	u.Lock.Unlock()
+	if h == nil {
+		return
+	}
+
+	// gather the entries while locked, as the upload may still be changing
+	up.stateLock.Lock()
+	dests := []*Destination{}
+	entries := []history.Entry{}
+	for _, d := range up.Destinations {
+		if d.recorded || (!evicted && !d.State.Terminal()) {
+			continue
+		}
+		e := historyEntry(up, d)
+		if !d.State.Terminal() {
+			e.State = string(up.State)
+			e.StateReason = up.StateReason
+		}
+		dests = append(dests, d)
+		entries = append(entries, e)
+	}
+	up.stateLock.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	hash := fileHash(up.Image.OriginalFilename)
+	for i := range entries {
+		entries[i].Hash = hash
+		err := h.Add(&entries[i])
+		if err != nil {
+			daulog.Errorf("could not record upload of %s in history: %s", up.Image.OriginalFilename, err)
+			continue
+		}
+		up.stateLock.Lock()
+		dests[i].recorded = true
+		up.stateLock.Unlock()
+	}
+}
+
+func historyEntry(up *Upload, d *Destination) history.Entry {
+	return history.Entry{
+		Filename:       up.Image.OriginalFilename,
+		UploadFilename: up.Image.UploadFilename(),
+		Watcher:        up.Watcher,
+		Destination:    d.Name,
+		URL:            d.Url,
+		MessageID:      d.MessageID,
+		Size:           d.Size,
+		Width:          d.Width,
+		Height:         d.Height,
+		State:          string(d.State),
+		StateReason:    d.StateReason,
+		DryRun:         up.DryRun,
+		AddedAt:        up.AddedAt,
+		UploadedAt:     d.UploadedAt,
+	}
+}
+
+// fileHash returns the hex encoded SHA-256 of a file, or an empty string
+// if it cannot be read.
+func fileHash(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
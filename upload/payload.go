@@ -0,0 +1,56 @@
+package upload
+
+import (
+	"encoding/json"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+// message flags, see https://discord.com/developers/docs/resources/channel#message-object-message-flags
+const (
+	flagSuppressEmbeds        = 1 << 2
+	flagSuppressNotifications = 1 << 12
+)
+
+// webhookPayload is sent to discord as the payload_json field alongside
+// the file.
+type webhookPayload struct {
+	Username        string          `json:"username,omitempty"`
+	AvatarURL       string          `json:"avatar_url,omitempty"`
+	AllowedMentions allowedMentions `json:"allowed_mentions"`
+	Flags           int             `json:"flags,omitempty"`
+}
+
+type allowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// newPayload creates the payload for uploads from a watcher.
+func newPayload(conf config.Watcher) webhookPayload {
+	p := webhookPayload{
+		Username:  conf.Username,
+		AvatarURL: conf.AvatarURL,
+		// an empty list means nobody can be pinged
+		AllowedMentions: allowedMentions{Parse: []string{}},
+	}
+	p.AllowedMentions.Parse = append(p.AllowedMentions.Parse, conf.AllowedMentions...)
+	if conf.SuppressEmbeds {
+		p.Flags |= flagSuppressEmbeds
+	}
+	if conf.SuppressNotifications {
+		p.Flags |= flagSuppressNotifications
+	}
+	return p
+}
+
+// marshalPayload encodes the payload, it is replaced by tests.
+var marshalPayload = json.Marshal
+
+// params returns the form fields to send with the upload
+func (p webhookPayload) params() (map[string]string, error) {
+	b, err := marshalPayload(p)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{"payload_json": string(b)}, nil
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the rate that bytes can be sent. It can be shared
+// between any number of uploads, and the limit can be changed while they
+// are in progress. A limit of zero means unlimited.
+type rateLimiter struct {
+	lock      sync.Mutex
+	limit     int64   // bytes per second
+	allowance float64 // bytes which can be sent now, may be negative
+	last      time.Time
+}
+
+func newRateLimiter(limit int64) *rateLimiter {
+	return &rateLimiter{limit: limit, last: time.Now()}
+}
+
+// SetLimit changes the limit, in bytes per second.
+func (r *rateLimiter) SetLimit(limit int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.limit = limit
+	if r.allowance > float64(limit) {
+		r.allowance = float64(limit)
+	}
+}
+
+// Limit returns the limit, in bytes per second.
+func (r *rateLimiter) Limit() int64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.limit
+}
+
+// wait blocks until n more bytes may be sent, or the context is cancelled.
+func (r *rateLimiter) wait(ctx context.Context, n int) error {
+	r.lock.Lock()
+	now := time.Now()
+	if r.limit <= 0 {
+		r.last = now
+		r.allowance = 0
+		r.lock.Unlock()
+		return nil
+	}
+	// accumulate up to a second's worth of allowance
+	r.allowance += now.Sub(r.last).Seconds() * float64(r.limit)
+	if r.allowance > float64(r.limit) {
+		r.allowance = float64(r.limit)
+	}
+	r.last = now
+	r.allowance -= float64(n)
+	var delay time.Duration
+	if r.allowance < 0 {
+		delay = time.Duration(-r.allowance / float64(r.limit) * float64(time.Second))
+	}
+	r.lock.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// effectiveLimit returns the lowest limit of those that are set, or zero if
+// none are.
+func effectiveLimit(limiters []*rateLimiter) int64 {
+	var lowest int64
+	for _, l := range limiters {
+		limit := l.Limit()
+		if limit > 0 && (lowest == 0 || limit < lowest) {
+			lowest = limit
+		}
+	}
+	return lowest
+}
+
+// progressReader reads the upload body, honouring the rate limits and
+// recording how much has been sent. The progress is changed while holding
+// lock, the state lock of the upload, so it can be read consistently.
+type progressReader struct {
+	r        io.Reader
+	ctx      context.Context
+	limiters []*rateLimiter
+	dest     *Destination
+	lock     *sync.Mutex
+}
+
+// limitedChunkSize is the most we read at once while limited, so the rate
+// is smooth even for small limits.
+const limitedChunkSize = 16 * 1024
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	limit := effectiveLimit(p.limiters)
+	p.lock.Lock()
+	p.dest.RateLimit = limit
+	p.lock.Unlock()
+	if limit > 0 && len(b) > limitedChunkSize {
+		b = b[:limitedChunkSize]
+	}
+	n, err := p.r.Read(b)
+	for _, l := range p.limiters {
+		if waitErr := l.wait(p.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	p.lock.Lock()
+	p.dest.BytesSent += int64(n)
+	p.lock.Unlock()
+	return n, err
+}
@@ -0,0 +1,136 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	i "image"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/httpclient"
+)
+
+func TestRateLimitedReader(t *testing.T) {
+	global := newRateLimiter(0)
+	watcher := newRateLimiter(100_000)
+	d := &Destination{}
+
+	start := time.Now()
+	r := &progressReader{
+		r:        bytes.NewReader(make([]byte, 50_000)),
+		ctx:      context.Background(),
+		limiters: []*rateLimiter{global, watcher},
+		dest:     d,
+		lock:     &sync.Mutex{},
+	}
+	n, err := io.Copy(ioutil.Discard, r)
+	if err != nil || n != 50_000 {
+		t.Fatalf("read %d bytes, err %v", n, err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("50KB at 100KB/s took only %s", elapsed)
+	}
+	if d.BytesSent != 50_000 {
+		t.Errorf("progress not recorded, %d bytes sent", d.BytesSent)
+	}
+	if d.RateLimit != 100_000 {
+		t.Errorf("rate limit not recorded, %d", d.RateLimit)
+	}
+
+	// removing the limit should take effect immediately
+	watcher.SetLimit(0)
+	start = time.Now()
+	r.r = bytes.NewReader(make([]byte, 1_000_000))
+	io.Copy(ioutil.Discard, r)
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("unlimited read was too slow")
+	}
+}
+
+func TestRateLimitCancel(t *testing.T) {
+	l := newRateLimiter(1000)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx, 10_000); err == nil {
+		t.Error("wait should have been cancelled")
+	}
+}
+
+func TestLimitedUploadLongerThanTimeout(t *testing.T) {
+	// the whole upload takes about two seconds, the timeout is one
+	if err := httpclient.Configure(config.HTTPConfig{Timeout: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer httpclient.Configure(config.DefaultHTTPConfig())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		resp, _ := DoGoodUpload(r)
+		io.Copy(w, resp.Body)
+	}))
+	defer server.Close()
+
+	f, err := os.CreateTemp("", "dautest-upload-*.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	im := i.NewRGBA(i.Rect(0, 0, 100, 100))
+	rand.Read(im.Pix)
+	png.Encode(f, im)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	u := testUpload(f.Name(), server.URL)
+	u.retryPolicy = config.RetryPolicy{Attempts: 1}
+	u.limiters = []*rateLimiter{newRateLimiter(20_000)}
+	start := time.Now()
+	if err := u.processUpload(); err != nil {
+		t.Fatalf("limited upload failed: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("upload should have taken longer than the timeout, took %s", elapsed)
+	}
+	if u.State != StateComplete {
+		t.Errorf("expected complete, got %s", u.State)
+	}
+}
+
+func TestProgressWhileMarshalling(t *testing.T) {
+	u := &Upload{Destinations: []*Destination{{}}}
+	r := &progressReader{
+		r:        bytes.NewReader(make([]byte, 200_000)),
+		ctx:      context.Background(),
+		limiters: []*rateLimiter{newRateLimiter(0)},
+		dest:     u.Destinations[0],
+		lock:     &u.stateLock,
+	}
+	done := make(chan bool)
+	go func() {
+		io.Copy(ioutil.Discard, r)
+		close(done)
+	}()
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		if _, err := json.Marshal(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u.Destinations[0].BytesSent != 200_000 {
+		t.Errorf("expected 200000 bytes sent, got %d", u.Destinations[0].BytesSent)
+	}
+}
@@ -0,0 +1,109 @@
+package upload
+
+import "time"
+
+// Filters for List.
+const (
+	FilterAll      = ""
+	FilterActive   = "active"   // uploads which have not finished
+	FilterFinished = "finished" // uploads in a terminal state
+)
+
+// prune removes finished uploads from the list once there are more than the
+// retention policy allows, or they are too old. Removed uploads are recorded
+// in the history.
+func (u *Uploader) prune(now time.Time) {
+	u.Lock.Lock()
+	evicted := u.evict(now)
+	u.Lock.Unlock()
+
+	for _, up := range evicted {
+		u.recordHistory(up, true)
+		up.Image.Cleanup()
+		up.Image.Discard()
+	}
+}
+
+// evict removes the uploads which should no longer be kept from the list,
+// returning them. Failed uploads can be retried, so they do not count
+// towards the maximum number kept and are only removed once they are too
+// old. The lock must be held.
+func (u *Uploader) evict(now time.Time) []*Upload {
+	policy := u.retention.WithDefaults()
+	maxAge := time.Duration(policy.MaxAge) * time.Minute
+
+	finished := 0
+	finishedAt := make([]time.Time, len(u.Uploads))
+	failed := make([]bool, len(u.Uploads))
+	for i, up := range u.Uploads {
+		finishedAt[i] = up.finishedAt()
+		state, _ := up.CurrentState()
+		failed[i] = state == StateFailed
+		if !finishedAt[i].IsZero() && !failed[i] {
+			finished++
+		}
+	}
+
+	// uploads are in the order they were found, so the oldest go first
+	kept := make([]*Upload, 0, len(u.Uploads))
+	evicted := []*Upload{}
+	for i, up := range u.Uploads {
+		if finishedAt[i].IsZero() {
+			kept = append(kept, up)
+			continue
+		}
+		tooOld := now.Sub(finishedAt[i]) > maxAge
+		if failed[i] && tooOld {
+			evicted = append(evicted, up)
+			continue
+		}
+		if !failed[i] && (finished > policy.MaxCount || tooOld) {
+			evicted = append(evicted, up)
+			finished--
+			continue
+		}
+		kept = append(kept, up)
+	}
+	u.Uploads = kept
+	return evicted
+}
+
+// List returns the uploads matching the filter, skipping the first offset
+// and returning at most limit (0 for no limit), along with the total number
+// matching. Finished uploads are listed most recent first, otherwise uploads
+// are in the order they were found.
+func (u *Uploader) List(filter string, offset, limit int) ([]*Upload, int) {
+	u.Lock.Lock()
+	defer u.Lock.Unlock()
+
+	matching := []*Upload{}
+	for _, up := range u.Uploads {
+		state, _ := up.CurrentState()
+		switch filter {
+		case FilterActive:
+			if state.Terminal() {
+				continue
+			}
+		case FilterFinished:
+			if !state.Terminal() {
+				continue
+			}
+		}
+		matching = append(matching, up)
+	}
+	if filter == FilterFinished {
+		for i, j := 0, len(matching)-1; i < j; i, j = i+1, j-1 {
+			matching[i], matching[j] = matching[j], matching[i]
+		}
+	}
+
+	total := len(matching)
+	if offset > total {
+		offset = total
+	}
+	matching = matching[offset:]
+	if limit > 0 && limit < len(matching) {
+		matching = matching[:limit]
+	}
+	return matching, total
+}
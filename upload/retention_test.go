@@ -0,0 +1,109 @@
+package upload
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
+	"github.com/tardisx/discord-auto-upload/image"
+)
+
+func testUploader(states ...State) *Uploader {
+	u := NewUploader()
+	for i, s := range states {
+		u.Uploads = append(u.Uploads, &Upload{
+			Id:           int32(i + 1),
+			State:        s,
+			Transitions:  []Transition{{To: s, At: time.Now()}},
+			Image:        &image.Store{OriginalFilename: "/nonexistent.png"},
+			Destinations: newDestinations([]config.Destination{{WebHookURL: "https://127.0.0.1/"}}),
+		})
+	}
+	return u
+}
+
+func TestEvictByCount(t *testing.T) {
+	u := testUploader(StateComplete, StatePending, StateSkipped, StateFailed, StateQueued)
+	u.retention = config.RetentionPolicy{MaxCount: 1}
+	evicted := u.evict(time.Now())
+	if len(evicted) != 1 || evicted[0].Id != 1 {
+		t.Errorf("expected the oldest finished upload to be evicted, got %#v", evicted)
+	}
+	if len(u.Uploads) != 4 {
+		t.Errorf("expected 4 uploads to be kept, got %d", len(u.Uploads))
+	}
+}
+
+func TestEvictByAge(t *testing.T) {
+	u := testUploader(StateComplete, StateUploading)
+	u.retention = config.RetentionPolicy{MaxAge: 10}
+	now := time.Now()
+	if len(u.evict(now)) != 0 {
+		t.Error("nothing should be evicted yet")
+	}
+	evicted := u.evict(now.Add(11 * time.Minute))
+	if len(evicted) != 1 || evicted[0].Id != 1 {
+		t.Errorf("expected the first upload to be evicted, got %#v", evicted)
+	}
+}
+
+func TestEvictKeepsFailed(t *testing.T) {
+	u := testUploader(StateFailed, StateComplete, StateFailed, StateComplete)
+	u.retention = config.RetentionPolicy{MaxCount: 1, MaxAge: 10}
+	now := time.Now()
+	evicted := u.evict(now)
+	if len(evicted) != 1 || evicted[0].Id != 2 {
+		t.Errorf("only the older complete upload should be evicted, got %#v", evicted)
+	}
+	if len(u.Uploads) != 3 || u.Uploads[0].Id != 1 || u.Uploads[1].Id != 3 {
+		t.Errorf("failed uploads should be kept for retrying, kept %d", len(u.Uploads))
+	}
+
+	evicted = u.evict(now.Add(11 * time.Minute))
+	if len(evicted) != 3 || len(u.Uploads) != 0 {
+		t.Errorf("old failed uploads should be evicted, got %#v", evicted)
+	}
+}
+
+func TestPruneRecordsHistory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dautest-*")
+	defer os.RemoveAll(dir)
+	h, err := history.Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	u := testUploader(StateSkipped, StateSkipped)
+	u.SetHistory(h)
+	u.retention = config.RetentionPolicy{MaxCount: 1}
+	u.prune(time.Now())
+
+	page, _ := h.Query(history.Query{})
+	if page.Total != 1 || page.Entries[0].State != string(StateSkipped) {
+		t.Errorf("expected the skipped upload in the history, got %#v", page)
+	}
+}
+
+func TestList(t *testing.T) {
+	u := testUploader(StateComplete, StatePending, StateSkipped, StateFailed, StateQueued)
+
+	ups, total := u.List(FilterActive, 0, 0)
+	if total != 2 || ups[0].Id != 2 || ups[1].Id != 5 {
+		t.Errorf("unexpected active uploads %#v", ups)
+	}
+
+	ups, total = u.List(FilterFinished, 1, 1)
+	if total != 3 || len(ups) != 1 || ups[0].Id != 3 {
+		t.Errorf("unexpected page of finished uploads %#v", ups)
+	}
+
+	ups, total = u.List(FilterAll, 10, 0)
+	if total != 5 || len(ups) != 0 {
+		t.Errorf("offset past the end should return nothing, got %#v", ups)
+	}
+}
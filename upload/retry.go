@@ -0,0 +1,83 @@
+package upload
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+// uploadError describes a failed upload attempt. Permanent errors are those
+// which can never succeed, no matter how many times they are retried.
+type uploadError struct {
+	permanent  bool
+	reason     string        // human readable, suitable for StateReason
+	retryAfter time.Duration // minimum time to wait, if the server told us
+	err        error
+
+	// webhookRejected is true if discord said the webhook is invalid
+	webhookRejected bool
+}
+
+func (e *uploadError) Error() string {
+	return e.err.Error()
+}
+
+func (e *uploadError) Unwrap() error {
+	return e.err
+}
+
+func permanentError(reason string, err error) *uploadError {
+	return &uploadError{permanent: true, reason: reason, err: err}
+}
+
+func transientError(reason string, err error) *uploadError {
+	return &uploadError{permanent: false, reason: reason, err: err}
+}
+
+// classifyResponse turns an unsuccessful HTTP response from discord into
+// an uploadError, deciding if it is worth retrying.
+func classifyResponse(resp *http.Response) *uploadError {
+	code := resp.StatusCode
+	switch {
+	case code == http.StatusRequestEntityTooLarge:
+		return permanentError("discord API said file too large", fmt.Errorf("received 413 - file too large"))
+	case code == http.StatusUnauthorized || code == http.StatusForbidden || code == http.StatusNotFound:
+		e := permanentError(
+			fmt.Sprintf("webhook is invalid or has been deleted (HTTP %d)", code),
+			fmt.Errorf("received %d - webhook invalid", code))
+		e.webhookRejected = true
+		return e
+	case code == http.StatusBadRequest:
+		return permanentError("discord API rejected the request (HTTP 400)", fmt.Errorf("received 400 - bad request"))
+	case code == http.StatusTooManyRequests:
+		e := transientError("rate limited by discord (HTTP 429)", fmt.Errorf("received 429 - rate limited"))
+		if secs, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil && secs > 0 {
+			e.retryAfter = time.Duration(secs * float64(time.Second))
+		}
+		return e
+	case code == http.StatusRequestTimeout || code >= 500:
+		return transientError(fmt.Sprintf("discord API error (HTTP %d)", code), fmt.Errorf("received %d", code))
+	case code >= 400:
+		return permanentError(fmt.Sprintf("discord API refused the upload (HTTP %d)", code), fmt.Errorf("received %d", code))
+	}
+	return transientError(fmt.Sprintf("unexpected response (HTTP %d)", code), fmt.Errorf("received %d", code))
+}
+
+// retryDelay returns how long to wait before retry number n (starting at 1).
+// The delay doubles with each retry, up to the policy's maximum, and is then
+// randomised by the jitter fraction.
+func retryDelay(policy config.RetryPolicy, n int) time.Duration {
+	base := float64(policy.BaseDelay) * math.Pow(2, float64(n-1))
+	if base > float64(policy.MaxDelay) {
+		base = float64(policy.MaxDelay)
+	}
+	if policy.Jitter > 0 {
+		base = base * (1 + policy.Jitter*(rand.Float64()*2-1))
+	}
+	return time.Duration(base * float64(time.Second))
+}
@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/image"
+
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// routeDestinations works out where a file should be sent. The first
+// matching rule replaces the watcher's primary webhook, the extra
+// destinations always receive the file. The name of the matched rule is
+// returned, or an empty string if the default was used.
+func routeDestinations(conf config.Watcher, file string, now time.Time) ([]config.Destination, string) {
+	dests := conf.AllDestinations()
+	for i, rule := range conf.Rules {
+		if !ruleMatches(rule, file, now) {
+			continue
+		}
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("rule %d", i+1)
+		}
+		daulog.Infof("%s matched %s", file, name)
+		dests[0] = config.Destination{Name: rule.Name, WebHookURL: rule.WebHookURL}
+		return dests, name
+	}
+	return dests, ""
+}
+
+// ruleMatches checks if every condition set on the rule is true for the file.
+func ruleMatches(rule config.RoutingRule, file string, now time.Time) bool {
+	if rule.Pattern != "" && !patternMatches(rule.Pattern, file) {
+		return false
+	}
+
+	if rule.StartTime != "" && !timeMatches(rule.StartTime, rule.EndTime, now) {
+		return false
+	}
+
+	if rule.MinWidth > 0 || rule.MinHeight > 0 || rule.MaxWidth > 0 || rule.MaxHeight > 0 {
+		width, height, err := image.Dimensions(file)
+		if err != nil {
+			daulog.Errorf("could not check dimensions of %s for routing: %s", file, err)
+			return false
+		}
+		if (rule.MinWidth > 0 && width < rule.MinWidth) ||
+			(rule.MinHeight > 0 && height < rule.MinHeight) ||
+			(rule.MaxWidth > 0 && width > rule.MaxWidth) ||
+			(rule.MaxHeight > 0 && height > rule.MaxHeight) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// patternMatches matches a glob pattern against the trailing components of
+// the path, so "*/Elden Ring/*" matches "/home/me/shots/Elden Ring/1.png".
+func patternMatches(pattern string, file string) bool {
+	patternParts := strings.Split(pattern, "/")
+	fileParts := strings.Split(filepath.ToSlash(file), "/")
+	if len(patternParts) > len(fileParts) {
+		return false
+	}
+	fileParts = fileParts[len(fileParts)-len(patternParts):]
+	for i := range patternParts {
+		matched, err := path.Match(patternParts[i], fileParts[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// timeMatches checks if now is between the start and end times of day. The
+// period may span midnight.
+func timeMatches(start, end string, now time.Time) bool {
+	startT, err1 := time.Parse(config.TimeOfDayFormat, start)
+	endT, err2 := time.Parse(config.TimeOfDayFormat, end)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	startMins := startT.Hour()*60 + startT.Minute()
+	endMins := endT.Hour()*60 + endT.Minute()
+	nowMins := now.Hour()*60 + now.Minute()
+
+	if startMins <= endMins {
+		return nowMins >= startMins && nowMins < endMins
+	}
+	return nowMins >= startMins || nowMins < endMins
+}
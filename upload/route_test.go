@@ -0,0 +1,74 @@
+package upload
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+)
+
+func TestPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		file    string
+		matches bool
+	}{
+		{"*/Elden Ring/*", "/home/me/shots/Elden Ring/1.png", true},
+		{"*/Elden Ring/*", "/home/me/shots/Doom/1.png", false},
+		{"*/Elden Ring/*", "/home/me/shots/Elden Ring/thumbs/1.png", false},
+		{"*.jpg", "/home/me/shots/1.jpg", true},
+		{"*.jpg", "/home/me/shots/1.png", false},
+		{"a/b/c/d/e", "b/c/d/e", false},
+	}
+	for _, test := range tests {
+		if patternMatches(test.pattern, test.file) != test.matches {
+			t.Errorf("%s against %s should be %t", test.pattern, test.file, test.matches)
+		}
+	}
+}
+
+func TestTimeMatches(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2022, 1, 1, h, m, 0, 0, time.Local) }
+
+	if !timeMatches("09:00", "17:00", at(12, 0)) {
+		t.Error("midday should be in working hours")
+	}
+	if timeMatches("09:00", "17:00", at(17, 0)) {
+		t.Error("end time should be exclusive")
+	}
+	if !timeMatches("22:00", "02:00", at(1, 30)) {
+		t.Error("should span midnight")
+	}
+	if timeMatches("22:00", "02:00", at(12, 0)) {
+		t.Error("midday should not be overnight")
+	}
+}
+
+func TestRouteDestinations(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	conf := config.Watcher{
+		WebHookURL:        "https://default/",
+		ExtraDestinations: []config.Destination{{Name: "archive", WebHookURL: "https://archive/"}},
+		Rules: []config.RoutingRule{
+			{Name: "big ones", MinWidth: 1000, WebHookURL: "https://big/"},
+			{Pattern: "*.png", WebHookURL: "https://png/"},
+		},
+	}
+
+	dests, rule := routeDestinations(conf, f, time.Now())
+	if rule != "rule 2" {
+		t.Errorf("wrong rule matched: '%s'", rule)
+	}
+	if len(dests) != 2 || dests[0].WebHookURL != "https://png/" || dests[1].WebHookURL != "https://archive/" {
+		t.Errorf("wrong destinations: %v", dests)
+	}
+
+	conf.Rules = conf.Rules[:1]
+	dests, rule = routeDestinations(conf, f, time.Now())
+	if rule != "" || dests[0].WebHookURL != "https://default/" {
+		t.Errorf("should have used the default, got '%s' %v", rule, dests)
+	}
+}
@@ -0,0 +1,268 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/image"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+// Transition is a single change of an upload's state.
+type Transition struct {
+	From   State     `json:"from"`
+	To     State     `json:"to"`
+	At     time.Time `json:"at"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// legalTransitions lists the states each state may change to. The empty
+// state is that of an upload which has just been created, which is skipped
+// straight away if it is a near duplicate.
+var legalTransitions = map[State][]State{
+	"":             {StatePending, StateQueued, StateSkipped},
+	StatePending:   {StateQueued, StateSkipped, StateCancelled},
+	StateQueued:    {StateUploading, StateCancelled},
+	StateUploading: {StateComplete, StateFailed, StateCancelled},
+	StateFailed:    {StateQueued},
+}
+
+func legalTransition(from, to State) bool {
+	for _, s := range legalTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionLocked changes the state of the upload, if the change is
+// allowed, returning the event to publish. The state lock must be held.
+func (u *Upload) transitionLocked(to State, reason string) (Event, error) {
+	if !legalTransition(u.State, to) {
+		return Event{}, fmt.Errorf("cannot change upload from '%s' to '%s'", u.State, to)
+	}
+	t := Transition{From: u.State, To: to, At: time.Now(), Reason: reason}
+	u.State = to
+	u.StateReason = reason
+	u.Transitions = append(u.Transitions, t)
+	return Event{Upload: u.Id, Filename: u.Image.OriginalFilename, Watcher: u.Watcher, Transition: t}, nil
+}
+
+// transition changes the state of the upload, if the change is allowed.
+func (u *Upload) transition(to State, reason string) error {
+	u.stateLock.Lock()
+	ev, err := u.transitionLocked(to, reason)
+	u.stateLock.Unlock()
+	if err != nil {
+		daulog.Errorf("upload of %s: %s", u.Image.OriginalFilename, err)
+		return err
+	}
+	u.events.publish(ev)
+	return nil
+}
+
+// transitionFrom changes the state of the upload, only if it is currently
+// in the state from. The action describes the change for the error message.
+func (u *Upload) transitionFrom(from, to State, action string) error {
+	u.stateLock.Lock()
+	if u.State != from {
+		state := u.State
+		u.stateLock.Unlock()
+		return fmt.Errorf("cannot %s an upload in state '%s'", action, state)
+	}
+	ev, err := u.transitionLocked(to, "")
+	u.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	u.events.publish(ev)
+	return nil
+}
+
+// CurrentState returns the state of the upload, and the reason for it.
+func (u *Upload) CurrentState() (State, string) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return u.State, u.StateReason
+}
+
+// finishedAt returns when the upload reached a terminal state, or the zero
+// time if it has not.
+func (u *Upload) finishedAt() time.Time {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if !u.State.Terminal() || len(u.Transitions) == 0 {
+		return time.Time{}
+	}
+	return u.Transitions[len(u.Transitions)-1].At
+}
+
+// Start queues a pending upload.
+func (u *Upload) Start() error {
+	return u.transitionFrom(StatePending, StateQueued, "start")
+}
+
+// Skip rejects a pending upload, it will never be uploaded.
+func (u *Upload) Skip() error {
+	return u.skip("")
+}
+
+// skip rejects a pending upload, giving the reason.
+func (u *Upload) skip(reason string) error {
+	u.stateLock.Lock()
+	if u.State != StatePending {
+		state := u.State
+		u.stateLock.Unlock()
+		return fmt.Errorf("cannot skip an upload in state '%s'", state)
+	}
+	ev, err := u.transitionLocked(StateSkipped, reason)
+	u.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	u.events.publish(ev)
+	u.Image.Cleanup()
+	return nil
+}
+
+// ImageSnapshot returns a copy of the upload's image settings, which can be
+// used without racing with Modify or the upload being prepared.
+func (u *Upload) ImageSnapshot() image.Store {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return *u.Image
+}
+
+// Modify calls f to change the image of a pending upload. The upload cannot
+// be started while f runs.
+func (u *Upload) Modify(f func(s *image.Store)) error {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	if u.State != StatePending {
+		return fmt.Errorf("cannot modify an upload in state '%s'", u.State)
+	}
+	f(u.Image)
+	return nil
+}
+
+// Cancel stops an upload which has not yet finished. If the upload is in
+// progress the request is aborted, any pending retries will not happen, and
+// ErrCancelRequested is returned as the upload may already have been sent.
+func (u *Upload) Cancel() error {
+	u.stateLock.Lock()
+	if u.State.Terminal() {
+		state := u.State
+		u.stateLock.Unlock()
+		return fmt.Errorf("cannot cancel an upload in state '%s'", state)
+	}
+	if u.cancel != nil {
+		u.cancel()
+	}
+	// if it is uploading, processUpload will notice the cancellation and
+	// clean up after itself, unless the upload has already been sent
+	if u.State == StateUploading {
+		u.stateLock.Unlock()
+		return ErrCancelRequested
+	}
+	ev, err := u.cancelLocked()
+	u.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	u.cancelled(ev)
+	return nil
+}
+
+// markCancelled is used by processUpload once it notices the upload was
+// cancelled.
+func (u *Upload) markCancelled() {
+	u.stateLock.Lock()
+	ev, err := u.cancelLocked()
+	u.stateLock.Unlock()
+	if err != nil {
+		daulog.Errorf("upload of %s: %s", u.Image.OriginalFilename, err)
+		return
+	}
+	u.cancelled(ev)
+}
+
+// cancelLocked marks the upload, and any unfinished destinations, as
+// cancelled. The state lock must be held.
+func (u *Upload) cancelLocked() (Event, error) {
+	ev, err := u.transitionLocked(StateCancelled, "cancelled by user")
+	if err != nil {
+		return ev, err
+	}
+	for _, d := range u.Destinations {
+		if !d.State.Terminal() {
+			d.State = StateCancelled
+			d.StateReason = "cancelled by user"
+		}
+	}
+	return ev, nil
+}
+
+func (u *Upload) cancelled(ev Event) {
+	daulog.Infof("Upload of %s cancelled", u.Image.OriginalFilename)
+	u.events.publish(ev)
+	u.Image.Cleanup()
+}
+
+// Retry requeues a failed upload, so it will be attempted again with a fresh
+// set of retries. Only the destinations which failed are retried.
+func (u *Upload) Retry() error {
+	u.stateLock.Lock()
+	if u.State != StateFailed {
+		state := u.State
+		u.stateLock.Unlock()
+		return fmt.Errorf("cannot retry an upload in state '%s'", state)
+	}
+	for _, d := range u.Destinations {
+		if d.State == StateFailed {
+			d.State = StateQueued
+			d.StateReason = ""
+			d.recorded = false
+			d.webhookRejected = false
+		}
+	}
+	ev, err := u.transitionLocked(StateQueued, "")
+	u.stateLock.Unlock()
+	if err != nil {
+		return err
+	}
+	u.events.publish(ev)
+	return nil
+}
+
+// RejectedWebhooks returns the destinations of the upload whose webhook
+// discord said was invalid or deleted.
+func (u *Upload) RejectedWebhooks() []Destination {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	rejected := []Destination{}
+	for _, d := range u.Destinations {
+		if d.webhookRejected {
+			rejected = append(rejected, Destination{Name: d.Name, State: d.State, StateReason: d.StateReason})
+		}
+	}
+	return rejected
+}
+
+// setDestinationState changes the state of one of the upload's destinations.
+func (u *Upload) setDestinationState(d *Destination, state State, reason string) {
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	d.State = state
+	d.StateReason = reason
+}
+
+// MarshalJSON holds the state lock, so the upload and its destinations are
+// consistent.
+func (u *Upload) MarshalJSON() ([]byte, error) {
+	type upload Upload // without the MarshalJSON method
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	return json.Marshal((*upload)(u))
+}
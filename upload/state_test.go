@@ -0,0 +1,57 @@
+package upload
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/image"
+)
+
+func TestStateTransitions(t *testing.T) {
+	f := tempImageSmall()
+	uploader := NewUploader()
+	events, unsubscribe := uploader.Subscribe()
+	defer unsubscribe()
+
+	uploader.AddFile(f, config.Watcher{Path: "/screenshots", WebHookURL: "https://127.0.0.1/", HoldUploads: true})
+	u := uploader.Uploads[0]
+
+	if err := u.Skip(); err != nil {
+		t.Fatalf("could not skip pending upload: %s", err)
+	}
+	if err := u.Start(); err == nil {
+		t.Error("skipped upload should not be startable")
+	}
+	if err := u.Modify(func(s *image.Store) { s.Spoiler = true }); err == nil || u.Image.Spoiler {
+		t.Error("skipped upload should not be modifiable")
+	}
+	if err := u.Retry(); err == nil {
+		t.Error("skipped upload should not be retryable")
+	}
+
+	if len(u.Transitions) != 2 || u.Transitions[0].To != StatePending || u.Transitions[1].From != StatePending || u.Transitions[1].To != StateSkipped {
+		t.Errorf("unexpected transitions %#v", u.Transitions)
+	}
+
+	for _, want := range []State{StatePending, StateSkipped} {
+		select {
+		case e := <-events:
+			if e.To != want || e.Upload != u.Id || e.Watcher != "/screenshots" {
+				t.Errorf("expected event for %s, got %#v", want, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %s", want)
+		}
+	}
+}
+
+func TestIllegalTransition(t *testing.T) {
+	u := &Upload{State: StateComplete, Image: &image.Store{}}
+	if err := u.transition(StateQueued, ""); err == nil {
+		t.Error("complete upload should not be requeued")
+	}
+	if u.State != StateComplete || len(u.Transitions) != 0 {
+		t.Error("illegal transition changed the upload")
+	}
+}
@@ -4,6 +4,7 @@ package upload
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -12,11 +13,14 @@ import (
 	"log"
 	"mime/multipart"
 	"net/http"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
+	"github.com/tardisx/discord-auto-upload/httpclient"
 	"github.com/tardisx/discord-auto-upload/image"
 
 	daulog "github.com/tardisx/discord-auto-upload/log"
@@ -32,8 +36,22 @@ const (
 	StateComplete     State = "Complete"         // finished successfully
 	StateFailed       State = "Failed"           // failed
 	StateSkipped      State = "Skipped"          // user did not want to upload
+	StateCancelled    State = "Cancelled"        // user cancelled the upload after it was queued
 )
 
+// Terminal returns true if no further changes will happen to an upload
+// in this state, without user intervention.
+func (s State) Terminal() bool {
+	return s == StateComplete || s == StateFailed || s == StateSkipped || s == StateCancelled
+}
+
+var errCancelled = errors.New("upload cancelled")
+
+// ErrCancelRequested is returned by Cancel for an upload which is in
+// progress. The request is aborted, but if it has already been sent the
+// upload may still complete.
+var ErrCancelRequested = errors.New("cancellation requested, the upload is in progress")
+
 var currentId int32
 
 type HTTPClient interface {
@@ -43,71 +61,264 @@ type HTTPClient interface {
 type Uploader struct {
 	Uploads []*Upload `json:"uploads"`
 	Lock    sync.Mutex
+
+	// rate limits for all uploads, and for each watcher by path
+	globalLimit   *rateLimiter
+	watcherLimits map[string]*rateLimiter
+
+	dryRun    bool
+	dryRunDir string
+
+	// history records finished uploads, if set
+	history *history.Store
+
+	// retention determines when finished uploads are removed from Uploads
+	retention config.RetentionPolicy
+
+	events *eventBus
+
+	// recentHashes are the perceptual hashes of the latest images found by
+	// each watcher, by path, to find near duplicates
+	recentHashes map[string][]recentHash
 }
 
 type Upload struct {
 	Id         int32     `json:"id"`
+	AddedAt    time.Time `json:"added_at"`
 	UploadedAt time.Time `json:"uploaded_at"`
 
-	Image *image.Store
+	// Watcher is the path of the watcher which found the file
+	Watcher string `json:"watcher"`
 
-	webhookURL string
+	Image *image.Store
 
-	usernameOverride string
+	payload webhookPayload
 
 	Url string `json:"url"` // url on the discord CDN
 
 	Width  int `json:"width"`
 	Height int `json:"height"`
 
+	// State must only be changed through the methods in state.go, which
+	// check that the change is allowed
 	State       State  `json:"state"`
 	StateReason string `json:"state_reason"`
 
+	// Transitions is the history of state changes, oldest first
+	Transitions []Transition `json:"transitions"`
+
+	// stateLock protects the state of the upload and its destinations
+	stateLock sync.Mutex
+	events    *eventBus
+
+	// DryRun is true if the upload will be written to disk rather than
+	// sent to discord
+	DryRun bool `json:"dry_run"`
+
+	// Rule is the name of the routing rule which chose the webhook, empty
+	// if the watcher's default was used
+	Rule string `json:"rule"`
+
+	// Duplicate is the earlier upload this image looks almost the same as,
+	// if it was skipped or held for that reason
+	Duplicate *DuplicateOf `json:"duplicate,omitempty"`
+
+	// Destinations are the webhooks this upload will be sent to
+	Destinations []*Destination `json:"destinations"`
+
+	// Collage lists the files in the contact sheet, if this upload is one
+	Collage []string `json:"collage,omitempty"`
+
+	// duplicates is the perceptual hash of the image, if the watcher looks
+	// for near duplicates
+	duplicates duplicateCheck
+
+	retryPolicy config.RetryPolicy
+	limiters    []*rateLimiter
+
+	// ctx is cancelled when the user cancels the upload, aborting any
+	// request in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	Client HTTPClient `json:"-"`
 }
 
+// Destination is a single webhook that an upload is sent to, along with the
+// progress of the upload to that webhook.
+type Destination struct {
+	Name       string `json:"name"`
+	webhookURL string
+
+	Url        string    `json:"url"` // url on the discord CDN
+	MessageID  string    `json:"message_id"`
+	Size       int64     `json:"size"` // bytes, as reported by discord
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	UploadedAt time.Time `json:"uploaded_at"`
+
+	State       State  `json:"state"`
+	StateReason string `json:"state_reason"`
+	Attempts    int    `json:"attempts"` // number of upload attempts made so far
+
+	// progress of the current attempt
+	BytesSent  int64 `json:"bytes_sent"`
+	BytesTotal int64 `json:"bytes_total"`
+	RateLimit  int64 `json:"rate_limit"` // bytes per second, 0 if unlimited
+
+	// recorded is true once the current state has been written to history
+	recorded bool
+
+	// webhookRejected is true if discord said the webhook is invalid
+	webhookRejected bool
+}
+
 func NewUploader() *Uploader {
 	u := Uploader{}
 	uploads := make([]*Upload, 0)
 	u.Uploads = uploads
+	u.globalLimit = newRateLimiter(0)
+	u.watcherLimits = make(map[string]*rateLimiter)
+	u.retention = config.DefaultRetentionPolicy()
+	u.events = newEventBus()
+	u.recentHashes = make(map[string][]recentHash)
 	return &u
 }
 
+// ApplyConfig applies the global upload settings from the configuration.
+// New bandwidth limits take effect immediately, even for uploads in progress.
+func (u *Uploader) ApplyConfig(conf *config.ConfigV3) {
+	u.Lock.Lock()
+	defer u.Lock.Unlock()
+	u.dryRun = conf.DryRun
+	u.dryRunDir = conf.DryRunDir
+	u.retention = conf.Retention.WithDefaults()
+	u.globalLimit.SetLimit(conf.UploadRateLimit)
+	for _, w := range conf.Watchers {
+		u.watcherLimiter(w).SetLimit(w.UploadRateLimit)
+	}
+}
+
+// watcherLimiter returns the rate limiter for a watcher, creating it if
+// necessary. The lock must be held.
+func (u *Uploader) watcherLimiter(w config.Watcher) *rateLimiter {
+	l, ok := u.watcherLimits[w.Path]
+	if !ok {
+		l = newRateLimiter(w.UploadRateLimit)
+		u.watcherLimits[w.Path] = l
+	}
+	return l
+}
+
 func (u *Uploader) AddFile(file string, conf config.Watcher) {
+	u.add(u.newUpload(file, conf), conf, "")
+}
+
+// newUpload creates an upload of a file found by a watcher, which is not
+// yet in the list of uploads.
+func (u *Uploader) newUpload(file string, conf config.Watcher) *Upload {
+	// work out where it is going before taking the lock, as the rules
+	// may need to look at the image
+	dests, rule := routeDestinations(conf, file, time.Now())
+
+	store := &image.Store{
+		OriginalFilename: file,
+		Watermark:        !conf.NoWatermark,
+		WatermarkOptions: conf.Watermark.Image(),
+		MaxBytes:         8_000_000,
+		FilenameTemplate: conf.FilenameTemplate,
+		Spoiler:          conf.Spoiler,
+		ConvertPNGToJPEG: conf.ConvertPNGToJPEG,
+		Metadata:         conf.Metadata,
+		Transform:        conf.Transform.Image(),
+	}
+	for _, r := range conf.Redactions {
+		store.FixedRedactions = append(store.FixedRedactions, r.Image())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Upload{
+		AddedAt:      time.Now(),
+		UploadedAt:   time.Time{},
+		Watcher:      conf.Path,
+		Image:        store,
+		payload:      newPayload(conf),
+		retryPolicy:  conf.Retry,
+		Url:          "",
+		Rule:         rule,
+		Destinations: newDestinations(dests),
+		events:       u.events,
+		ctx:          ctx,
+		cancel:       cancel,
+		Client:       nil,
+		duplicates:   hashForDuplicates(file, conf),
+	}
+}
+
+// add gives the upload an id, if it does not have one yet, and adds it to
+// the list of uploads. If skipReason is not empty the upload is skipped
+// straight away.
+func (u *Uploader) add(thisUpload *Upload, conf config.Watcher, skipReason string) {
 	u.Lock.Lock()
-	atomic.AddInt32(&currentId, 1)
-	thisUpload := Upload{
-		Id:               currentId,
-		UploadedAt:       time.Time{},
-		Image:            &image.Store{OriginalFilename: file, Watermark: !conf.NoWatermark, MaxBytes: 8_000_000},
-		webhookURL:       conf.WebHookURL,
-		usernameOverride: conf.Username,
-		Url:              "",
-		State:            StateQueued,
-		Client:           nil,
+	defer u.Lock.Unlock()
+	if thisUpload.Id == 0 {
+		thisUpload.Id = atomic.AddInt32(&currentId, 1)
+	}
+	thisUpload.limiters = []*rateLimiter{u.globalLimit, u.watcherLimiter(conf)}
+	// in a dry run, the "upload" just writes the files to disk
+	if u.dryRun || conf.DryRun {
+		thisUpload.DryRun = true
+		thisUpload.Client = newDryRunClient(u.dryRunDir)
 	}
 	// if the user wants uploads to be held for editing etc,
 	// set it to Pending instead
+	initial := StateQueued
 	if conf.HoldUploads {
-		thisUpload.State = StatePending
-		thisUpload.StateReason = ""
+		initial = StatePending
 	}
-	u.Uploads = append(u.Uploads, &thisUpload)
-	u.Lock.Unlock()
+	reason := ""
+	if skipReason != "" {
+		initial, reason = StateSkipped, skipReason
+	} else if state, why, found := u.checkDuplicate(thisUpload); found {
+		initial, reason = state, why
+	}
+	thisUpload.transition(initial, reason)
+	u.Uploads = append(u.Uploads, thisUpload)
+}
 
+// newDestinations creates the upload destinations for the configured webhooks.
+func newDestinations(confDests []config.Destination) []*Destination {
+	dests := make([]*Destination, 0, len(confDests))
+	for i, cd := range confDests {
+		name := cd.Name
+		if name == "" {
+			name = fmt.Sprintf("webhook %d", i+1)
+		}
+		dests = append(dests, &Destination{Name: name, webhookURL: cd.WebHookURL, State: StateQueued})
+	}
+	return dests
 }
 
 // Upload uploads any files that have not yet been uploaded
 func (u *Uploader) Upload() {
-	u.Lock.Lock()
+	u.prune(time.Now())
 
+	// claim the queued uploads while locked, so no other watcher
+	// will try to upload them, but do not hold the lock while uploading
+	// so they can still be inspected and cancelled
+	u.Lock.Lock()
+	toUpload := []*Upload{}
 	for _, upload := range u.Uploads {
-		if upload.State == StateQueued {
-			upload.processUpload()
+		if upload.transitionFrom(StateQueued, StateUploading, "upload") == nil {
+			toUpload = append(toUpload, upload)
 		}
 	}
 	u.Lock.Unlock()
 
+	for _, upload := range toUpload {
+		upload.processUpload()
+		u.recordHistory(upload, false)
+	}
 }
 
 func (u *Uploader) UploadById(id int32) *Upload {
@@ -122,146 +333,276 @@ func (u *Uploader) UploadById(id int32) *Upload {
 	return nil
 }
 
+// processUpload prepares the image once, then sends it to each destination
+// which has not yet received it.
 func (u *Upload) processUpload() error {
 	daulog.Infof("Uploading: %s", u.Image.OriginalFilename)
 
-	if u.webhookURL == "" {
+	if len(u.Destinations) == 0 {
 		daulog.Error("WebHookURL is not configured - cannot upload!")
+		u.fail("webhook url not configured")
 		return errors.New("webhook url not configured")
 	}
 
-	extraParams := map[string]string{}
-
-	if u.usernameOverride != "" {
-		daulog.Infof("Overriding username with '%s'", u.usernameOverride)
-		extraParams["username"] = u.usernameOverride
+	if u.payload.Username != "" {
+		daulog.Infof("Overriding username with '%s'", u.payload.Username)
 	}
-
-	type DiscordAPIResponseAttachment struct {
-		URL      string
-		ProxyURL string
-		Size     int
-		Width    int
-		Height   int
-		Filename string
+	extraParams, err := u.payload.params()
+	if err != nil {
+		u.fail(fmt.Sprintf("could not create payload: %s", err))
+		return fmt.Errorf("could not create payload: %s", err)
 	}
 
-	type DiscordAPIResponse struct {
-		Attachments []DiscordAPIResponseAttachment
-		ID          int64 `json:",string"`
+	if u.Client == nil {
+		// if no client was specified (as a unit test would) then
+		// use the shared one, without a timeout for sending the body
+		u.Client = httpclient.UploadClient()
 	}
 
-	var retriesRemaining = 5
-	for retriesRemaining > 0 {
+	if u.ctx == nil {
+		u.ctx, u.cancel = context.WithCancel(context.Background())
+	}
 
-		// open an io.ReadCloser for the file we intend to upload
-		var err error
+	err = u.updateImage((*image.Store).Prepare)
+	if err != nil {
+		daulog.Errorf("could not prepare image: %s", err)
+		u.fail(fmt.Sprintf("could not prepare image: %s", err))
+		u.updateImage(cleanupIntermediate)
+		return err
+	}
 
-		imageData, err := u.Image.ReadCloser()
-		if err != nil {
-			panic(err)
+	failed := 0
+	var lastErr error
+	for _, d := range u.Destinations {
+		if d.State == StateComplete {
+			continue
+		}
+		err := u.uploadToDestination(d, extraParams)
+		if err == errCancelled {
+			u.markCancelled()
+			return errCancelled
 		}
-
-		request, err := newfileUploadRequest(u.webhookURL, extraParams, "file", u.Image.UploadFilename(), imageData)
 		if err != nil {
-			daulog.Errorf("error creating upload request: %s", err)
-			return fmt.Errorf("could not create upload request: %s", err)
+			failed++
+			lastErr = err
 		}
-		start := time.Now()
+	}
 
-		if u.Client == nil {
-			// if no client was specified (a unit test) then create
-			// a default one
-			u.Client = &http.Client{Timeout: time.Second * 30}
+	if failed > 0 {
+		reason := fmt.Sprintf("failed to upload to %d of %d destinations", failed, len(u.Destinations))
+		if len(u.Destinations) == 1 {
+			reason = u.Destinations[0].StateReason
 		}
+		u.transition(StateFailed, reason)
+		u.updateImage(cleanupIntermediate)
+		return lastErr
+	}
 
-		resp, err := u.Client.Do(request)
-		if err != nil {
-			daulog.Errorf("Error performing request: %s", err)
-			retriesRemaining--
-			sleepForRetries(retriesRemaining)
-			continue
-		} else {
-			if resp.StatusCode == 413 {
-				// just fail immediately, we know this means the file was too big
-				daulog.Error("413 received - file too large")
-				u.State = StateFailed
-				u.StateReason = "discord API said file too large"
-				return errors.New("received 413 - file too large")
-			}
+	if u.ctx.Err() != nil {
+		daulog.Infof("upload of %s was cancelled, but had already been sent", u.Image.OriginalFilename)
+	}
+	u.stateLock.Lock()
+	u.UploadedAt = time.Now()
+	u.stateLock.Unlock()
+	u.transition(StateComplete, "")
 
-			if resp.StatusCode != 200 {
-				// {"message": "Request entity too large", "code": 40005}
-				daulog.Errorf("Bad response code from server: %d", resp.StatusCode)
-				if b, err := ioutil.ReadAll(resp.Body); err == nil {
-					daulog.Errorf("Body:\n%s", string(b))
-				}
-				retriesRemaining--
-				sleepForRetries(retriesRemaining)
-				continue
-			}
+	// remove any temporary files
+	u.Image.Cleanup()
+	return nil
+}
 
-			resBody, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				daulog.Errorf("could not deal with body: %s", err)
-				retriesRemaining--
-				sleepForRetries(retriesRemaining)
-				continue
-			}
-			resp.Body.Close()
+// updateImage calls f on a copy of the image, then stores the changed copy
+// with the lock held, so the image can be read while it is slowly prepared.
+// Only processUpload changes the image of an upload in progress, so no
+// changes are lost.
+func (u *Upload) updateImage(f func(s *image.Store) error) error {
+	s := u.ImageSnapshot()
+	err := f(&s)
+	u.stateLock.Lock()
+	*u.Image = s
+	u.stateLock.Unlock()
+	return err
+}
 
-			var res DiscordAPIResponse
-			err = json.Unmarshal(resBody, &res)
+// cleanupIntermediate is Store.CleanupIntermediate, for updateImage.
+func cleanupIntermediate(s *image.Store) error {
+	s.CleanupIntermediate()
+	return nil
+}
 
-			//  {"id": "851092588608880670", "type": 0, "content": "", "channel_id": "849615269706203171", "author": {"bot": true, "id": "849615314274484224", "username": "abcdedf", "avatar": null, "discriminator": "0000"}, "attachments": [{"id": "851092588332449812", "filename": "dau480457962.png", "size": 859505, "url": "https://cdn.discordapp.com/attachments/849615269706203171/851092588332449812/dau480457962.png", "proxy_url": "https://media.discordapp.net/attachments/849615269706203171/851092588332449812/dau480457962.png", "width": 640, "height": 640, "content_type": "image/png"}], "embeds": [], "mentions": [], "mention_roles": [], "pinned": false, "mention_everyone": false, "tts": false, "timestamp": "2021-06-06T13:38:05.660000+00:00", "edited_timestamp": null, "flags": 0, "components": [], "webhook_id": "849615314274484224"}
+// fail marks the upload, and each destination which has not received it,
+// as failed before anything was sent.
+func (u *Upload) fail(reason string) {
+	for _, d := range u.Destinations {
+		if d.State != StateComplete {
+			u.setDestinationState(d, StateFailed, reason)
+		}
+	}
+	u.transition(StateFailed, reason)
+}
+
+// uploadToDestination sends the image to a single destination, retrying
+// according to the retry policy.
+func (u *Upload) uploadToDestination(d *Destination, extraParams map[string]string) error {
+	if d.webhookURL == "" {
+		daulog.Errorf("WebHookURL for %s is not configured - cannot upload!", d.Name)
+		u.setDestinationState(d, StateFailed, "webhook url not configured")
+		return errors.New("webhook url not configured")
+	}
 
-			daulog.Debugf("Response: %s", string(resBody[:]))
+	policy := u.retryPolicy.WithDefaults()
+	u.setDestinationState(d, StateUploading, "")
 
-			if err != nil {
-				daulog.Errorf("could not parse JSON: %s", err)
-				daulog.Errorf("Response was: %s", string(resBody[:]))
-				retriesRemaining--
-				sleepForRetries(retriesRemaining)
-				continue
+	var lastErr *uploadError
+	for attempt := 1; attempt <= policy.Attempts; attempt++ {
+		if attempt > 1 {
+			delay := retryDelay(policy, attempt-1)
+			if lastErr.retryAfter > delay {
+				delay = lastErr.retryAfter
 			}
-			if len(res.Attachments) < 1 {
-				daulog.Error("bad response - no attachments?")
-				retriesRemaining--
-				sleepForRetries(retriesRemaining)
-				continue
+			daulog.Errorf("Will retry %s in %s (%d remaining attempts)", d.Name, delay.Round(time.Second), policy.Attempts-attempt+1)
+			select {
+			case <-time.After(delay):
+			case <-u.ctx.Done():
 			}
-			var a = res.Attachments[0]
-			elapsed := time.Since(start)
-			rate := float64(a.Size) / elapsed.Seconds() / 1024.0
+		}
 
-			daulog.Infof("Uploaded to %s %dx%d", a.URL, a.Width, a.Height)
-			daulog.Infof("id: %d, %d bytes transferred in %.2f seconds (%.2f KiB/s)", res.ID, a.Size, elapsed.Seconds(), rate)
+		if u.ctx.Err() != nil {
+			return errCancelled
+		}
 
-			u.Url = a.URL
-			u.State = StateComplete
-			u.StateReason = ""
-			u.Width = a.Width
-			u.Height = a.Height
-			u.UploadedAt = time.Now()
+		u.stateLock.Lock()
+		d.Attempts++
+		u.stateLock.Unlock()
+		err := u.attemptUpload(d, extraParams)
+		if err == nil {
+			return nil
+		}
+		if u.ctx.Err() != nil {
+			return errCancelled
+		}
 
-			break
+		lastErr = err
+		if err.permanent {
+			daulog.Errorf("Upload to %s failed permanently, will not retry: %s", d.Name, err)
+			u.stateLock.Lock()
+			d.webhookRejected = err.webhookRejected
+			u.stateLock.Unlock()
+			u.setDestinationState(d, StateFailed, err.reason)
+			return err
 		}
+		daulog.Errorf("Upload attempt %d of %d to %s failed: %s", attempt, policy.Attempts, d.Name, err)
 	}
 
-	// remove any temporary files
-	u.Image.Cleanup()
+	daulog.Errorf("Failed to upload to %s, even after all retries", d.Name)
+	u.setDestinationState(d, StateFailed, fmt.Sprintf("could not upload after %d attempts: %s", policy.Attempts, lastErr.reason))
+	return errors.New("could not upload after all retries")
+}
 
-	if retriesRemaining == 0 {
-		daulog.Error("Failed to upload, even after all retries")
-		u.State = StateFailed
-		u.StateReason = "could not upload after all retries"
-		return errors.New("could not upload after all retries")
+// attemptUpload makes a single attempt to send the image to a destination.
+func (u *Upload) attemptUpload(d *Destination, extraParams map[string]string) *uploadError {
+
+	type DiscordAPIResponseAttachment struct {
+		URL      string
+		ProxyURL string
+		Size     int
+		Width    int
+		Height   int
+		Filename string
+	}
+
+	type DiscordAPIResponse struct {
+		Attachments []DiscordAPIResponseAttachment
+		ID          int64 `json:",string"`
+	}
+
+	// open an io.ReadCloser for the file we intend to upload
+	imageData, err := u.Image.ReadCloser()
+	if err != nil {
+		daulog.Errorf("could not prepare image: %s", err)
+		return permanentError(fmt.Sprintf("could not prepare image: %s", err), err)
+	}
+	defer imageData.Close()
+
+	request, err := newfileUploadRequest(u.ctx, d.webhookURL, extraParams, "file", u.Image.UploadFilename(), imageData)
+	if err != nil {
+		daulog.Errorf("error creating upload request: %s", err)
+		return permanentError(fmt.Sprintf("could not create upload request: %s", err), err)
+	}
+	u.stateLock.Lock()
+	d.BytesSent = 0
+	d.BytesTotal = request.ContentLength
+	u.stateLock.Unlock()
+	request.Body = ioutil.NopCloser(&progressReader{r: request.Body, ctx: u.ctx, limiters: u.limiters, dest: d, lock: &u.stateLock})
+	start := time.Now()
+
+	resp, err := u.Client.Do(request)
+	if err != nil {
+		daulog.Errorf("Error performing request: %s", err)
+		return transientError(fmt.Sprintf("request failed: %s", err), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		// {"message": "Request entity too large", "code": 40005}
+		daulog.Errorf("Bad response code from server: %d", resp.StatusCode)
+		if b, err := ioutil.ReadAll(resp.Body); err == nil {
+			daulog.Errorf("Body:\n%s", string(b))
+		}
+		return classifyResponse(resp)
+	}
+
+	resBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		daulog.Errorf("could not deal with body: %s", err)
+		return transientError(fmt.Sprintf("could not read response: %s", err), err)
+	}
+
+	var res DiscordAPIResponse
+	err = json.Unmarshal(resBody, &res)
+
+	//  {"id": "851092588608880670", "type": 0, "content": "", "channel_id": "849615269706203171", "author": {"bot": true, "id": "849615314274484224", "username": "abcdedf", "avatar": null, "discriminator": "0000"}, "attachments": [{"id": "851092588332449812", "filename": "dau480457962.png", "size": 859505, "url": "https://cdn.discordapp.com/attachments/849615269706203171/851092588332449812/dau480457962.png", "proxy_url": "https://media.discordapp.net/attachments/849615269706203171/851092588332449812/dau480457962.png", "width": 640, "height": 640, "content_type": "image/png"}], "embeds": [], "mentions": [], "mention_roles": [], "pinned": false, "mention_everyone": false, "tts": false, "timestamp": "2021-06-06T13:38:05.660000+00:00", "edited_timestamp": null, "flags": 0, "components": [], "webhook_id": "849615314274484224"}
+
+	daulog.Debugf("Response: %s", string(resBody[:]))
+
+	if err != nil {
+		daulog.Errorf("could not parse JSON: %s", err)
+		daulog.Errorf("Response was: %s", string(resBody[:]))
+		return transientError(fmt.Sprintf("could not parse response: %s", err), err)
+	}
+	if len(res.Attachments) < 1 {
+		daulog.Error("bad response - no attachments?")
+		return transientError("bad response - no attachments", errors.New("no attachments in response"))
+	}
+	var a = res.Attachments[0]
+	elapsed := time.Since(start)
+	rate := float64(a.Size) / elapsed.Seconds() / 1024.0
+
+	daulog.Infof("Uploaded to %s %dx%d", a.URL, a.Width, a.Height)
+	daulog.Infof("id: %d, %d bytes transferred in %.2f seconds (%.2f KiB/s)", res.ID, a.Size, elapsed.Seconds(), rate)
+
+	u.stateLock.Lock()
+	defer u.stateLock.Unlock()
+	d.Url = a.URL
+	d.MessageID = strconv.FormatInt(res.ID, 10)
+	d.Size = int64(a.Size)
+	d.Width = a.Width
+	d.Height = a.Height
+	d.State = StateComplete
+	d.StateReason = ""
+	d.UploadedAt = time.Now()
+
+	// the upload itself reports the first destination to complete
+	if u.Url == "" {
+		u.Url = a.URL
+		u.Width = a.Width
+		u.Height = a.Height
 	}
 
 	return nil
 }
 
-func newfileUploadRequest(uri string, params map[string]string, paramName string, filename string, filedata io.Reader) (*http.Request, error) {
+func newfileUploadRequest(ctx context.Context, uri string, params map[string]string, paramName string, filename string, filedata io.Reader) (*http.Request, error) {
 
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -282,16 +623,7 @@ func newfileUploadRequest(uri string, params map[string]string, paramName string
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", uri, body)
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, body)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
 	return req, err
 }
-
-func sleepForRetries(retry int) {
-	if retry == 0 {
-		return
-	}
-	retryTime := (6-retry)*(6-retry) + 6
-	daulog.Errorf("Will retry in %d seconds (%d remaining attempts)", retryTime, retry)
-	time.Sleep(time.Duration(retryTime) * time.Second)
-}
@@ -2,6 +2,8 @@ package upload
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	i "image"
 	"image/color"
 	"image/png"
@@ -9,6 +11,13 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
+	"github.com/tardisx/discord-auto-upload/image"
 )
 
 // https://www.thegreatcodeadventure.com/mocking-http-requests-in-golang/
@@ -36,40 +45,311 @@ func DoTooBigUpload(req *http.Request) (*http.Response, error) {
 	}, nil
 }
 
-// func TestSuccessfulUpload(t *testing.T) {
-// 	// create temporary file, processUpload requires that it exists, even though
-// 	// we will not really be uploading it here
-// 	f, _ := os.CreateTemp("", "dautest-upload-*")
-// 	defer os.Remove(f.Name())
-// 	u := Upload{webhookURL: "https://127.0.0.1/", Image: &image.Store{OriginalFilename: f.Name()}}
-// 	u.Client = &MockClient{DoFunc: DoGoodUpload}
-// 	err := u.processUpload()
-// 	if err != nil {
-// 		t.Errorf("error occured: %s", err)
-// 	}
-
-// 	if u.Url != "https://cdn.discordapp.com/attachments/849615269706203171/851092588332449812/dau480457962.png" {
-// 		t.Error("URL wrong")
-// 	}
-// }
-
-// func TestTooBigUpload(t *testing.T) {
-// 	// create temporary file, processUpload requires that it exists, even though
-// 	// we will not really be uploading it here
-// 	f, _ := os.CreateTemp("", "dautest-upload-*")
-// 	defer os.Remove(f.Name())
-// 	u := Upload{webhookURL: "https://127.0.0.1/", Image: &image.Store{OriginalFilename: f.Name()}}
-// 	u.Client = &MockClient{DoFunc: DoTooBigUpload}
-// 	err := u.processUpload()
-// 	if err == nil {
-// 		t.Error("error did not occur?")
-// 	} else if err.Error() != "received 413 - file too large" {
-// 		t.Errorf("wrong error occurred: %s", err.Error())
-// 	}
-// 	if u.State != StateFailed {
-// 		t.Error("upload should have been marked failed")
-// 	}
-// }
+func TestSuccessfulUpload(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: DoGoodUpload}
+	err := u.processUpload()
+	if err != nil {
+		t.Errorf("error occured: %s", err)
+	}
+
+	if u.Url != "https://cdn.discordapp.com/attachments/849615269706203171/851092588332449812/dau480457962.png" {
+		t.Error("URL wrong")
+	}
+	if u.Destinations[0].Attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", u.Destinations[0].Attempts)
+	}
+}
+
+func DoWebhookNotFound(req *http.Request) (*http.Response, error) {
+	r := ioutil.NopCloser(bytes.NewReader([]byte(`{"message": "Unknown Webhook", "code": 10015}`)))
+	return &http.Response{
+		StatusCode: 404,
+		Body:       r,
+	}, nil
+}
+
+func TestPermanentFailureNotRetried(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	calls := 0
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		calls++
+		return DoWebhookNotFound(req)
+	}}
+	err := u.processUpload()
+	if err == nil {
+		t.Error("error did not occur?")
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", calls)
+	}
+	if u.State != StateFailed {
+		t.Error("upload should have been marked failed")
+	}
+	if u.StateReason != "webhook is invalid or has been deleted (HTTP 404)" {
+		t.Errorf("wrong reason: %s", u.StateReason)
+	}
+
+	// a manual retry should put it back in the queue
+	if err := u.Retry(); err != nil {
+		t.Errorf("could not retry: %s", err)
+	}
+	if u.State != StateQueued {
+		t.Error("upload should have been queued")
+	}
+}
+
+func TestNoDestinationsFails(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	u := testUpload(f)
+	if err := u.processUpload(); err == nil {
+		t.Error("upload with no destinations should fail")
+	}
+	if u.State != StateFailed || u.StateReason != "webhook url not configured" {
+		t.Errorf("expected failed with a reason, got %s (%s)", u.State, u.StateReason)
+	}
+	if err := u.Retry(); err != nil {
+		t.Errorf("failed upload should be retryable: %s", err)
+	}
+}
+
+func TestPayloadErrorFails(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+	marshalPayload = func(v interface{}) ([]byte, error) {
+		return nil, errors.New("broken")
+	}
+	defer func() { marshalPayload = json.Marshal }()
+
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: DoGoodUpload}
+	if err := u.processUpload(); err == nil {
+		t.Error("upload with a bad payload should fail")
+	}
+	if u.State != StateFailed || u.StateReason != "could not create payload: broken" {
+		t.Errorf("expected failed with a reason, got %s (%s)", u.State, u.StateReason)
+	}
+	if u.Destinations[0].State != StateFailed || u.Destinations[0].Attempts != 0 {
+		t.Error("destination should have failed without an attempt")
+	}
+}
+
+func TestTooBigUpload(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: DoTooBigUpload}
+	err := u.processUpload()
+	if err == nil {
+		t.Error("error did not occur?")
+	} else if err.Error() != "received 413 - file too large" {
+		t.Errorf("wrong error occurred: %s", err.Error())
+	}
+	if u.State != StateFailed {
+		t.Error("upload should have been marked failed")
+	}
+}
+
+func TestCancelInFlight(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		// the user cancels while the request is in progress
+		if err := u.Cancel(); err != ErrCancelRequested {
+			t.Errorf("expected cancellation to be requested, got: %v", err)
+		}
+		return nil, req.Context().Err()
+	}}
+	err := u.processUpload()
+	if err != errCancelled {
+		t.Errorf("expected cancellation, got: %v", err)
+	}
+	if u.State != StateCancelled {
+		t.Errorf("upload should have been cancelled, is %s", u.State)
+	}
+	if u.Destinations[0].Attempts != 1 {
+		t.Errorf("should not have retried, made %d attempts", u.Destinations[0].Attempts)
+	}
+}
+
+func TestCancelTooLate(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		// discord has the file by the time the user cancels
+		if err := u.Cancel(); err != ErrCancelRequested {
+			t.Errorf("expected cancellation to be requested, got: %v", err)
+		}
+		return DoGoodUpload(req)
+	}}
+	if err := u.processUpload(); err != nil {
+		t.Errorf("upload should have completed, got: %v", err)
+	}
+	if u.State != StateComplete {
+		t.Errorf("upload should be reported as complete, is %s", u.State)
+	}
+}
+
+func TestSnapshotWhilePreparing(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	// the web interface reads the image while it is prepared, this is for
+	// go test -race
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Client = &MockClient{DoFunc: DoGoodUpload}
+	done := make(chan bool)
+	go func() {
+		u.processUpload()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if u.State != StateComplete {
+				t.Errorf("upload should have completed, is %s", u.State)
+			}
+			return
+		default:
+			u.ImageSnapshot()
+			if _, err := json.Marshal(u); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestCancelQueued(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	up := NewUploader()
+	up.AddFile(f, config.Watcher{WebHookURL: "https://127.0.0.1/"})
+	u := up.Uploads[0]
+	if err := u.Cancel(); err != nil {
+		t.Errorf("could not cancel: %s", err)
+	}
+	if u.State != StateCancelled {
+		t.Errorf("upload should have been cancelled, is %s", u.State)
+	}
+	if err := u.Cancel(); err == nil {
+		t.Error("should not be able to cancel a cancelled upload")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := config.RetryPolicy{Attempts: 5, BaseDelay: 10, MaxDelay: 60}
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 60 * time.Second}
+	for n, exp := range expected {
+		if d := retryDelay(p, n+1); d != exp {
+			t.Errorf("retry %d: expected %s got %s", n+1, exp, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for n := 0; n < 20; n++ {
+		d := retryDelay(p, 1)
+		if d < 5*time.Second || d > 15*time.Second {
+			t.Errorf("jittered delay %s out of range", d)
+		}
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	calls := map[string]int{}
+	u := testUpload(f, "https://127.0.0.1/good", "https://127.0.0.1/deleted")
+	u.Client = &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		calls[req.URL.Path]++
+		if req.URL.Path == "/deleted" {
+			return DoWebhookNotFound(req)
+		}
+		return DoGoodUpload(req)
+	}}
+	u.processUpload()
+
+	if u.State != StateFailed {
+		t.Errorf("upload should have failed, is %s", u.State)
+	}
+	if u.Destinations[0].State != StateComplete || u.Destinations[1].State != StateFailed {
+		t.Errorf("wrong destination states %s, %s", u.Destinations[0].State, u.Destinations[1].State)
+	}
+	if u.Url == "" {
+		t.Error("url of the successful destination not recorded")
+	}
+
+	// retrying should only send to the failed destination
+	u.Retry()
+	u.processUpload()
+	if calls["/good"] != 1 || calls["/deleted"] != 2 {
+		t.Errorf("wrong number of calls: %v", calls)
+	}
+}
+
+func TestPayload(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	var payload map[string]interface{}
+	u := testUpload(f, "https://127.0.0.1/")
+	u.payload = newPayload(config.Watcher{Username: "me", AvatarURL: "https://example.com/me.png", SuppressNotifications: true})
+	u.Client = &MockClient{DoFunc: func(req *http.Request) (*http.Response, error) {
+		json.Unmarshal([]byte(req.FormValue("payload_json")), &payload)
+		return DoGoodUpload(req)
+	}}
+	u.processUpload()
+
+	if payload["username"] != "me" || payload["avatar_url"] != "https://example.com/me.png" {
+		t.Errorf("identity not sent: %v", payload)
+	}
+	if payload["flags"] != float64(4096) {
+		t.Errorf("wrong flags: %v", payload["flags"])
+	}
+	mentions, _ := payload["allowed_mentions"].(map[string]interface{})
+	if parse, ok := mentions["parse"].([]interface{}); !ok || len(parse) != 0 {
+		t.Errorf("mentions should be disabled by default: %v", payload["allowed_mentions"])
+	}
+}
+
+// testUpload creates an upload of a file, destined for the webhooks
+func testUpload(f string, webhooks ...string) *Upload {
+	dests := []config.Destination{}
+	for _, wh := range webhooks {
+		dests = append(dests, config.Destination{WebHookURL: wh})
+	}
+	return &Upload{
+		Image:        &image.Store{OriginalFilename: f, MaxBytes: 8_000_000},
+		Destinations: newDestinations(dests),
+		State:        StateUploading,
+	}
+}
+
+// tempImageSmall creates a small PNG file, returning the filename
+func tempImageSmall() string {
+	img := i.NewRGBA(i.Rect(0, 0, 16, 16))
+	f, err := os.CreateTemp("", "dautest-upload-*.png")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	png.Encode(f, img)
+	return f.Name()
+}
 
 func tempImageGt8Mb() {
 	// about 12Mb
@@ -95,3 +375,36 @@ func tempImageGt8Mb() {
 	f, _ := os.Create("image.png")
 	png.Encode(f, img)
 }
+
+func TestHistoryRecorded(t *testing.T) {
+	f := tempImageSmall()
+	defer os.Remove(f)
+
+	dir, _ := ioutil.TempDir("", "dautest-*")
+	defer os.RemoveAll(dir)
+	h, err := history.Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	uploader := NewUploader()
+	uploader.SetHistory(h)
+	u := testUpload(f, "https://127.0.0.1/")
+	u.Watcher = "/screenshots"
+	u.Client = &MockClient{DoFunc: DoGoodUpload}
+	u.processUpload()
+	uploader.recordHistory(u, false)
+	// recording again should not duplicate the entry
+	uploader.recordHistory(u, false)
+
+	page, _ := h.Query(history.Query{})
+	if page.Total != 1 {
+		t.Fatalf("expected 1 history entry, got %d", page.Total)
+	}
+	e := page.Entries[0]
+	if e.Filename != f || e.Watcher != "/screenshots" || e.State != "Complete" || e.MessageID != "123456789012345678" ||
+		e.Size != 859505 || e.Width != 640 || len(e.Hash) != 64 {
+		t.Errorf("unexpected history entry %#v", e)
+	}
+}
@@ -0,0 +1,50 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tardisx/discord-auto-upload/httpclient"
+)
+
+// WebhookInfo is the information discord provides about a webhook.
+type WebhookInfo struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	ChannelID string `json:"channel_id"`
+	GuildID   string `json:"guild_id"`
+}
+
+// ValidateWebhook fetches a webhook from discord, to check that it exists
+// and is usable.
+func ValidateWebhook(webhookURL string) (WebhookInfo, error) {
+	info := WebhookInfo{}
+
+	resp, err := httpclient.Client().Get(webhookURL)
+	if err != nil {
+		return info, fmt.Errorf("could not check webhook: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusNotFound {
+		return info, fmt.Errorf("webhook is invalid or has been deleted (HTTP %d)", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return info, fmt.Errorf("could not check webhook (HTTP %d)", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return info, fmt.Errorf("could not read webhook details: %s", err)
+	}
+	err = json.Unmarshal(body, &info)
+	if err != nil {
+		return info, fmt.Errorf("could not parse webhook details: %s", err)
+	}
+	if info.ID == "" {
+		return info, fmt.Errorf("response does not look like a webhook")
+	}
+	return info, nil
+}
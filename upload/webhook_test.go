@@ -0,0 +1,32 @@
+package upload
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateWebhook(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/deleted") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"id":"123","name":"screenshots","channel_id":"456","guild_id":"789"}`))
+	}))
+	defer srv.Close()
+
+	info, err := ValidateWebhook(srv.URL + "/api/webhooks/123/abc")
+	if err != nil {
+		t.Fatalf("valid webhook failed: %s", err)
+	}
+	if info.Name != "screenshots" || info.ChannelID != "456" || info.GuildID != "789" {
+		t.Errorf("unexpected webhook info %#v", info)
+	}
+
+	_, err = ValidateWebhook(srv.URL + "/api/webhooks/123/deleted")
+	if err == nil || !strings.Contains(err.Error(), "HTTP 404") {
+		t.Errorf("deleted webhook should fail, got %v", err)
+	}
+}
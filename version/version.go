@@ -5,9 +5,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"time"
 
+	"github.com/tardisx/discord-auto-upload/httpclient"
 	daulog "github.com/tardisx/discord-auto-upload/log"
 
 	"golang.org/x/mod/semver"
@@ -55,7 +54,7 @@ func GetOnlineVersion() {
 
 	daulog.Info("checking for new version")
 
-	client := &http.Client{Timeout: time.Second * 5}
+	client := httpclient.Client()
 	resp, err := client.Get("https://api.github.com/repos/tardisx/discord-auto-upload/releases/latest")
 	if err != nil {
 		daulog.Errorf("WARNING: Update check failed: %s", err)
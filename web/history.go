@@ -0,0 +1,139 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/tardisx/discord-auto-upload/history"
+	daulog "github.com/tardisx/discord-auto-upload/log"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// historyQuery builds a history query from the request parameters. Dates
+// may be given as YYYY-MM-DD or RFC 3339 timestamps, a date for "to" includes
+// the whole of that day.
+func historyQuery(params url.Values) (history.Query, error) {
+	q := history.Query{
+		Search:      params.Get("q"),
+		Watcher:     params.Get("watcher"),
+		Destination: params.Get("destination"),
+		State:       params.Get("state"),
+		Limit:       defaultHistoryLimit,
+	}
+
+	var err error
+	if v := params.Get("from"); v != "" {
+		q.From, _, err = parseHistoryTime(v)
+		if err != nil {
+			return q, fmt.Errorf("bad from date: %s", err)
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		var dateOnly bool
+		q.To, dateOnly, err = parseHistoryTime(v)
+		if err != nil {
+			return q, fmt.Errorf("bad to date: %s", err)
+		}
+		if dateOnly {
+			q.To = q.To.AddDate(0, 0, 1)
+		}
+	}
+	if v := params.Get("offset"); v != "" {
+		q.Offset, err = strconv.Atoi(v)
+		if err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("bad offset")
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 || q.Limit > maxHistoryLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxHistoryLimit)
+		}
+	}
+	return q, nil
+}
+
+func parseHistoryTime(v string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
+
+// getHistory returns a page of the upload history.
+func (ws *WebService) getHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if ws.History == nil {
+		returnJSONError(w, "upload history is not available")
+		return
+	}
+
+	q, err := historyQuery(r.URL.Query())
+	if err != nil {
+		returnJSONError(w, err.Error())
+		return
+	}
+	page, err := ws.History.Query(q)
+	if err != nil {
+		daulog.Errorf("could not query history: %s", err)
+		returnJSONError(w, "could not read history")
+		return
+	}
+	resString, _ := json.Marshal(page)
+	w.Write(resString)
+}
+
+// exportHistory returns all of the history matching the filters as a
+// CSV or JSON file.
+func (ws *WebService) exportHistory(w http.ResponseWriter, r *http.Request) {
+	if ws.History == nil {
+		w.Header().Set("Content-Type", "application/json")
+		returnJSONError(w, "upload history is not available")
+		return
+	}
+
+	q, err := historyQuery(r.URL.Query())
+	if err == nil && r.URL.Query().Get("limit") == "" {
+		// exports are not paginated unless asked to be
+		q.Limit = 0
+	}
+	format := r.URL.Query().Get("format")
+	if err == nil && format != "csv" && format != "json" {
+		err = fmt.Errorf("format must be csv or json")
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		returnJSONError(w, err.Error())
+		return
+	}
+
+	page, err := ws.History.Query(q)
+	if err != nil {
+		daulog.Errorf("could not query history: %s", err)
+		w.Header().Set("Content-Type", "application/json")
+		returnJSONError(w, "could not read history")
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="dau-history.%s"`, format))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		err = history.WriteCSV(w, page.Entries)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(page.Entries)
+	}
+	if err != nil {
+		daulog.Errorf("could not export history: %s", err)
+	}
+}
@@ -1,12 +1,13 @@
 package web
 
 import (
+	"bytes"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"io/ioutil"
 	"log"
 	"mime"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
 	"github.com/tardisx/discord-auto-upload/image"
 	daulog "github.com/tardisx/discord-auto-upload/log"
 	"github.com/tardisx/discord-auto-upload/upload"
@@ -28,6 +30,7 @@ import (
 type WebService struct {
 	Config   *config.ConfigService
 	Uploader *upload.Uploader
+	History  *history.Store // may be nil if the history could not be opened
 }
 
 type ErrorResponse struct {
@@ -43,6 +46,19 @@ type StartUploadResponse struct {
 	Message string `json:"message"`
 }
 
+// CollageRequest asks for a collage of pending uploads.
+type CollageRequest struct {
+	Ids      []int32 `json:"ids"`
+	Instead  bool    `json:"instead"` // skip the uploads, rather than posting them after the collage
+	Columns  int     `json:"columns"`
+	CellSize int     `json:"cell_size"`
+	Captions bool    `json:"captions"`
+}
+
+type RateLimit struct {
+	Global int64 `json:"global"` // bytes per second, 0 for unlimited
+}
+
 //go:embed data
 var webFS embed.FS
 
@@ -146,6 +162,14 @@ func (ws *WebService) handleConfig(w http.ResponseWriter, r *http.Request) {
 			returnJSONError(w, "badly formed JSON")
 			return
 		}
+		if newConfig.ValidateWebhooks {
+			for _, res := range validateWebhooks(ws.Config.Config, &newConfig) {
+				if res.Error != "" {
+					returnJSONError(w, fmt.Sprintf("webhook for '%s' is not valid: %s", res.Path, res.Error))
+					return
+				}
+			}
+		}
 		ws.Config.Config = &newConfig
 		err = ws.Config.Save()
 		if err != nil {
@@ -163,9 +187,72 @@ func (ws *WebService) handleConfig(w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// handleRateLimit shows or changes the global upload rate limit. Changes
+// are saved, and take effect immediately without restarting the watchers.
+func (ws *WebService) handleRateLimit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == "POST" {
+		newLimit := RateLimit{}
+
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			returnJSONError(w, "could not read body?")
+			return
+		}
+		err = json.Unmarshal(b, &newLimit)
+		if err != nil {
+			returnJSONError(w, "badly formed JSON")
+			return
+		}
+
+		oldLimit := ws.Config.Config.UploadRateLimit
+		ws.Config.Config.UploadRateLimit = newLimit.Global
+		err = ws.Config.Save()
+		if err != nil {
+			ws.Config.Config.UploadRateLimit = oldLimit
+			returnJSONError(w, err.Error())
+			return
+		}
+		ws.Uploader.ApplyConfig(ws.Config.Config)
+	}
+
+	b, _ := json.Marshal(RateLimit{Global: ws.Config.Config.UploadRateLimit})
+	w.Write(b)
+}
+
+// getUploads returns the uploads. The optional "filter" parameter may be
+// "active" or "finished", and "offset" and "limit" select a page of them.
+// The total number of matching uploads is in the X-Total-Count header.
 func (ws *WebService) getUploads(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	ups := ws.Uploader.Uploads
+
+	params := r.URL.Query()
+	filter := params.Get("filter")
+	if filter != upload.FilterAll && filter != upload.FilterActive && filter != upload.FilterFinished {
+		returnJSONError(w, "filter must be active or finished")
+		return
+	}
+	offset, limit := 0, 0
+	var err error
+	if v := params.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			returnJSONError(w, "bad offset")
+			return
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			returnJSONError(w, "bad limit")
+			return
+		}
+	}
+
+	ups, total := ws.Uploader.List(filter, offset, limit)
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
 
 	text, err := json.Marshal(ups)
 	if err != nil {
@@ -176,9 +263,17 @@ func (ws *WebService) getUploads(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ws *WebService) imageThumb(w http.ResponseWriter, r *http.Request) {
+	ws.thumb(w, r, image.ThumbTypeOriginal)
+}
 
-	w.Header().Set("Content-Type", "image/png")
+func (ws *WebService) imageMarkedupThumb(w http.ResponseWriter, r *http.Request) {
+	ws.thumb(w, r, image.ThumbTypeMarkedUp)
+}
 
+// thumb sends a thumbnail of an upload. The optional size parameter is the
+// longest side in pixels. Browsers may keep thumbnails but must check they
+// are still current, as redactions and markup change them.
+func (ws *WebService) thumb(w http.ResponseWriter, r *http.Request, t image.ThumbType) {
 	vars := mux.Vars(r)
 	id, err := strconv.ParseInt(vars["id"], 10, 32)
 	if err != nil {
@@ -186,39 +281,44 @@ func (ws *WebService) imageThumb(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	size := image.DefaultThumbSize
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size < image.MinThumbSize || size > image.MaxThumbSize {
+			returnJSONError(w, fmt.Sprintf("bad size, should be between %d and %d", image.MinThumbSize, image.MaxThumbSize))
+			return
+		}
+	}
+
 	ul := ws.Uploader.UploadById(int32(id))
 	if ul == nil {
 		returnJSONError(w, "bad id")
 		return
 	}
-	err = ul.Image.ThumbPNG(image.ThumbTypeOriginal, w)
+
+	// a copy, as the upload may be modified while the thumbnail is made
+	store := ul.ImageSnapshot()
+	tag, err := store.ThumbTag(t, size)
 	if err != nil {
 		returnJSONError(w, "could not create thumb")
 		return
 	}
-}
-
-func (ws *WebService) imageMarkedupThumb(w http.ResponseWriter, r *http.Request) {
-
-	w.Header().Set("Content-Type", "image/png")
-
-	vars := mux.Vars(r)
-	id, err := strconv.ParseInt(vars["id"], 10, 32)
-	if err != nil {
-		returnJSONError(w, "bad id")
+	etag := `"` + tag + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if match := r.Header.Get("If-None-Match"); match == etag || match == "*" {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	ul := ws.Uploader.UploadById(int32(id))
-	if ul == nil {
-		returnJSONError(w, "bad id")
-		return
-	}
-	err = ul.Image.ThumbPNG(image.ThumbTypeMarkedUp, w)
+	thumb := bytes.Buffer{}
+	err = store.ThumbPNG(t, size, &thumb)
 	if err != nil {
 		returnJSONError(w, "could not create thumb")
 		return
 	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(thumb.Bytes())
 }
 
 func (ws *WebService) image(w http.ResponseWriter, r *http.Request) {
@@ -236,94 +336,167 @@ func (ws *WebService) image(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	img, err := os.Open(ul.Image.OriginalFilename)
+	// a copy, as the upload may be prepared while the image is sent
+	store := ul.ImageSnapshot()
+	err = store.WriteOriginal(w)
 	if err != nil {
+		daulog.Errorf("could not send image: %s", err)
 		returnJSONError(w, "could not open image file")
 		return
 	}
-	defer img.Close()
-	io.Copy(w, img)
 }
 
 func (ws *WebService) modifyUpload(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	if r.Method == "POST" {
+	if r.Method != "POST" {
+		returnJSONError(w, "bad request")
+		return
+	}
+
+	vars := mux.Vars(r)
+	change := vars["change"]
+	id, err := strconv.ParseInt(vars["id"], 10, 32)
+	if err != nil {
+		returnJSONError(w, "bad id")
+		return
+	}
+
+	anUpload := ws.Uploader.UploadById(int32(id))
+	if anUpload == nil {
+		returnJSONError(w, "bad id")
+		return
+	}
 
-		vars := mux.Vars(r)
-		change := vars["change"]
-		id, err := strconv.ParseInt(vars["id"], 10, 32)
+	// the upload checks that each change is allowed in its current state
+	var message string
+	switch change {
+	case "cancel":
+		err = anUpload.Cancel()
+		message = "upload cancelled"
+		if errors.Is(err, upload.ErrCancelRequested) {
+			err = nil
+			message = "cancellation requested, the upload is in progress and may still complete"
+		}
+	case "start":
+		err = anUpload.Start()
+		message = "upload queued"
+	case "skip":
+		err = anUpload.Skip()
+		message = "upload skipped"
+	case "retry":
+		err = anUpload.Retry()
+		message = "upload queued for retry"
+	case "spoiler":
+		err = anUpload.Modify(func(s *image.Store) {
+			s.Spoiler = !s.Spoiler
+			message = "upload will not be marked as a spoiler"
+			if s.Spoiler {
+				message = "upload will be marked as a spoiler"
+			}
+		})
+	case "markup":
+		newImageData := r.FormValue("image")
+		//data:image/png;base64,xxxx
+		// I know this is dumb, we should just send binary image data, but I can't
+		// see that Fabric makes that possible.
+		if strings.Index(newImageData, "data:image/png;base64,") != 0 {
+			returnJSONError(w, "bad image data")
+			return
+		}
+		imageDataBase64 := newImageData[22:]
+		b, err := base64.StdEncoding.DecodeString(imageDataBase64)
 		if err != nil {
-			returnJSONError(w, "bad id")
+			returnJSONError(w, err.Error())
 			return
 		}
 
-		anUpload := ws.Uploader.UploadById(int32(id))
-		if anUpload == nil {
-			returnJSONError(w, "bad id")
-			return
+		// write to a temporary file
+		tempfile, err := ioutil.TempFile("", "dau_markup-*")
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, err := tempfile.Write(b)
+		if n != len(b) {
+			log.Fatalf("only wrote %d bytes??", n)
+		}
+		if err != nil {
+			log.Fatalf("Could not write temp file: %v", err)
 		}
+		tempfile.Close()
 
-		if anUpload.State == upload.StatePending {
-			if change == "start" {
-				anUpload.State = upload.StateQueued
-				res := StartUploadResponse{Success: true, Message: "upload queued"}
-				resString, _ := json.Marshal(res)
-				w.Write(resString)
-				return
-			} else if change == "skip" {
-				anUpload.State = upload.StateSkipped
-				anUpload.Image.Cleanup()
-				res := StartUploadResponse{Success: true, Message: "upload skipped"}
-				resString, _ := json.Marshal(res)
-				w.Write(resString)
+		err = anUpload.Modify(func(s *image.Store) {
+			s.ModifiedFilename = tempfile.Name()
+		})
+		if err != nil {
+			os.Remove(tempfile.Name())
+			returnJSONError(w, err.Error())
+			return
+		}
+		message = "image modified"
+	case "redact":
+		// a list of image.Redaction, in pixels of the original image
+		regions := []image.Redaction{}
+		err = json.NewDecoder(r.Body).Decode(&regions)
+		if err != nil {
+			returnJSONError(w, "bad redactions: "+err.Error())
+			return
+		}
+		for _, region := range regions {
+			if err := region.Validate(false); err != nil {
+				returnJSONError(w, err.Error())
 				return
-			} else if change == "markup" {
-				newImageData := r.FormValue("image")
-				//data:image/png;base64,xxxx
-				// I know this is dumb, we should just send binary image data, but I can't
-				// see that Fabric makes that possible.
-				if strings.Index(newImageData, "data:image/png;base64,") != 0 {
-					returnJSONError(w, "bad image data")
-					return
-				}
-				imageDataBase64 := newImageData[22:]
-				b, err := base64.StdEncoding.DecodeString(imageDataBase64)
-				if err != nil {
-					returnJSONError(w, err.Error())
-					return
-				}
+			}
+		}
+		err = anUpload.Modify(func(s *image.Store) {
+			s.Redactions = regions
+		})
+		message = fmt.Sprintf("%d areas will be redacted", len(regions))
+	default:
+		returnJSONError(w, "bad change type")
+		return
+	}
 
-				// write to a temporary file
-				tempfile, err := ioutil.TempFile("", "dau_markup-*")
-				if err != nil {
-					log.Fatal(err)
-				}
-				n, err := tempfile.Write(b)
-				if n != len(b) {
-					log.Fatalf("only wrote %d bytes??", n)
-				}
-				if err != nil {
-					log.Fatalf("Could not write temp file: %v", err)
-				}
+	if err != nil {
+		returnJSONError(w, err.Error())
+		return
+	}
+	res := StartUploadResponse{Success: true, Message: message}
+	resString, _ := json.Marshal(res)
+	w.Write(resString)
+}
 
-				tempfile.Close()
-				anUpload.Image.ModifiedFilename = tempfile.Name()
+// collageUploads makes a collage of pending uploads and queues it.
+func (ws *WebService) collageUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
 
-			} else {
-				returnJSONError(w, "bad change type")
-				return
-			}
-		}
-		res := StartUploadResponse{Success: false, Message: "upload does not exist, or already queued"}
-		resString, _ := json.Marshal(res)
-		w.WriteHeader(400)
-		w.Write(resString)
+	if r.Method != "POST" {
+		returnJSONError(w, "bad request")
+		return
+	}
+
+	req := CollageRequest{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		returnJSONError(w, "badly formed JSON")
+		return
+	}
+	policy := config.CollagePolicy{Mode: "before", Columns: req.Columns, CellSize: req.CellSize}
+	if err := policy.Validate(); err != nil {
+		returnJSONError(w, err.Error())
 		return
 	}
-	returnJSONError(w, "bad request")
 
+	opts := image.CollageOptions{Columns: req.Columns, CellSize: req.CellSize, Captions: req.Captions}
+	collage, err := ws.Uploader.CollagePending(req.Ids, opts, req.Instead)
+	if err != nil {
+		returnJSONError(w, err.Error())
+		return
+	}
+	res := StartUploadResponse{Success: true, Message: fmt.Sprintf("collage of %d images queued as upload %d", len(collage.Collage), collage.Id)}
+	resString, _ := json.Marshal(res)
+	w.Write(resString)
 }
 
 func (ws *WebService) StartWebServer() {
@@ -332,6 +505,9 @@ func (ws *WebService) StartWebServer() {
 
 	r.HandleFunc("/rest/logs", ws.getLogs)
 	r.HandleFunc("/rest/uploads", ws.getUploads)
+	r.HandleFunc("/rest/uploads/collage", ws.collageUploads)
+	r.HandleFunc("/rest/history", ws.getHistory)
+	r.HandleFunc("/rest/history/export", ws.exportHistory)
 	r.HandleFunc("/rest/upload/{id:[0-9]+}/{change}", ws.modifyUpload)
 
 	r.HandleFunc("/rest/image/{id:[0-9]+}/thumb", ws.imageThumb)
@@ -340,6 +516,8 @@ func (ws *WebService) StartWebServer() {
 	r.HandleFunc("/rest/image/{id:[0-9]+}", ws.image)
 
 	r.HandleFunc("/rest/config", ws.handleConfig)
+	r.HandleFunc("/rest/config/validate", ws.handleValidateWebhooks)
+	r.HandleFunc("/rest/ratelimit", ws.handleRateLimit)
 	r.PathPrefix("/").HandlerFunc(ws.getStatic)
 
 	go func() {
@@ -1,13 +1,25 @@
 package web
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/history"
+	dauimage "github.com/tardisx/discord-auto-upload/image"
+	"github.com/tardisx/discord-auto-upload/upload"
 )
 
 func TestHome(t *testing.T) {
@@ -78,8 +90,298 @@ func TestGetConfig(t *testing.T) {
 		t.Errorf("expected error to be nil got %v", err)
 	}
 
-	exp := `{"WatchInterval":10,"Version":3,"Port":9090,"OpenBrowserOnStart":true,"Watchers":[{"WebHookURL":"https://webhook.url.here","Path":"/your/screenshot/dir/here","Username":"","NoWatermark":false,"HoldUploads":false,"Exclude":[]}]}`
+	exp := `{"WatchInterval":10,"Version":3,"Port":9090,"OpenBrowserOnStart":true,"ValidateWebhooks":false,"HTTP":{"ProxyURL":"","CAFile":"","TLSMinVersion":"1.2","ConnectTimeout":10,"Timeout":30,"KeepAlive":30},"UploadRateLimit":0,"DryRun":false,"DryRunDir":"","Retention":{"MaxCount":100,"MaxAge":1440},"Alerts":{"WebHookURL":"","Command":"","MinInterval":60,"DedupWindow":3600},"Watchers":[{"WebHookURL":"https://webhook.url.here","Path":"/your/screenshot/dir/here","Username":"","NoWatermark":false,"Watermark":{"Text":"","Position":"","Scale":0,"Foreground":"","Background":"","Logo":""},"HoldUploads":false,"Exclude":[],"Retry":{"Attempts":5,"BaseDelay":10,"MaxDelay":60,"Jitter":0.1},"FilenameTemplate":"","Spoiler":false,"ConvertPNGToJPEG":false,"Metadata":"safe","UploadRateLimit":0,"DryRun":false,"AvatarURL":"","AllowedMentions":[],"SuppressEmbeds":false,"SuppressNotifications":false,"ExtraDestinations":[],"Rules":[],"Redactions":[],"Transform":{"CropX":0,"CropY":0,"CropWidth":0,"CropHeight":0,"TrimBorders":false,"AspectRatio":"","Rotate":0,"FlipH":false,"FlipV":false,"MaxDimension":0},"Duplicates":{"Action":"","Threshold":6,"Recent":20},"Collage":{"Mode":"","MinImages":10,"Columns":0,"CellSize":320,"Captions":false}}]}`
 	if string(b) != exp {
 		t.Errorf("Got unexpected response\n%v\n%v", string(b), exp)
 	}
 }
+
+func TestRateLimit(t *testing.T) {
+	conf := config.DefaultConfigService()
+	conf.Config = config.DefaultConfig()
+	f, _ := ioutil.TempFile("", "dautest-*")
+	f.Close()
+	conf.ConfigFilename = f.Name()
+	defer os.Remove(f.Name())
+
+	s := WebService{Config: conf, Uploader: upload.NewUploader()}
+
+	req := httptest.NewRequest(http.MethodPost, "/rest/ratelimit", strings.NewReader(`{"global": 500000}`))
+	w := httptest.NewRecorder()
+	s.handleRateLimit(w, req)
+	res := w.Result()
+	defer res.Body.Close()
+
+	b, _ := ioutil.ReadAll(res.Body)
+	if string(b) != `{"global":500000}` {
+		t.Errorf("Got unexpected response %s", string(b))
+	}
+	if conf.Config.UploadRateLimit != 500000 {
+		t.Error("config was not changed")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/rest/ratelimit", strings.NewReader(`{"global": -1}`))
+	w = httptest.NewRecorder()
+	s.handleRateLimit(w, req)
+	if w.Result().StatusCode != 400 || conf.Config.UploadRateLimit != 500000 {
+		t.Error("negative rate limit should not be accepted")
+	}
+}
+
+func TestSaveConfigValidatesWebhooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	conf := config.DefaultConfigService()
+	conf.Config = config.DefaultConfig()
+	f, _ := ioutil.TempFile("", "dautest-*")
+	f.Close()
+	conf.ConfigFilename = f.Name()
+	defer os.Remove(f.Name())
+
+	dir, _ := ioutil.TempDir("", "dautest-*")
+	defer os.RemoveAll(dir)
+
+	newConfig := config.DefaultConfig()
+	newConfig.ValidateWebhooks = true
+	newConfig.Watchers[0].Path = dir
+	newConfig.Watchers[0].WebHookURL = srv.URL + "/api/webhooks/123/abc"
+	b, _ := json.Marshal(newConfig)
+
+	s := WebService{Config: conf, Uploader: upload.NewUploader()}
+	req := httptest.NewRequest(http.MethodPost, "/rest/config", bytes.NewReader(b))
+	w := httptest.NewRecorder()
+	s.handleConfig(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Errorf("config with a deleted webhook should not be saved")
+	}
+	if conf.Config.ValidateWebhooks {
+		t.Errorf("config was changed")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/rest/config/validate", bytes.NewReader(b))
+	w = httptest.NewRecorder()
+	s.handleValidateWebhooks(w, req)
+	res := WebhookValidationResponse{}
+	json.NewDecoder(w.Result().Body).Decode(&res)
+	if len(res.Webhooks) != 1 || !strings.Contains(res.Webhooks[0].Error, "HTTP 404") {
+		t.Errorf("unexpected validation response %#v", res)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "dautest-*")
+	defer os.RemoveAll(dir)
+	h, err := history.Open(filepath.Join(dir, "history.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, f := range []string{"one.png", "two.png", "three.png"} {
+		h.Add(&history.Entry{Filename: f, State: "Complete", AddedAt: time.Now()})
+	}
+
+	s := WebService{History: h}
+	req := httptest.NewRequest(http.MethodGet, "/rest/history?q=t&limit=1", nil)
+	w := httptest.NewRecorder()
+	s.getHistory(w, req)
+	page := history.Page{}
+	json.NewDecoder(w.Result().Body).Decode(&page)
+	if page.Total != 2 || len(page.Entries) != 1 || page.Entries[0].Filename != "three.png" {
+		t.Errorf("unexpected history page %#v", page)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/rest/history?limit=0", nil)
+	w = httptest.NewRecorder()
+	s.getHistory(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Error("bad limit should be rejected")
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/rest/history/export?format=csv", nil)
+	w = httptest.NewRecorder()
+	s.exportHistory(w, req)
+	b, _ := ioutil.ReadAll(w.Result().Body)
+	if w.Result().Header.Get("Content-Type") != "text/csv" || strings.Count(string(b), "\n") != 4 {
+		t.Errorf("unexpected CSV export %s", string(b))
+	}
+}
+
+func TestGetUploadsPaginated(t *testing.T) {
+	up := upload.NewUploader()
+	for _, s := range []upload.State{upload.StateComplete, upload.StateQueued, upload.StateFailed, upload.StateSkipped} {
+		up.Uploads = append(up.Uploads, &upload.Upload{State: s})
+	}
+	s := WebService{Uploader: up}
+
+	req := httptest.NewRequest(http.MethodGet, "/rest/uploads?filter=finished&limit=2", nil)
+	w := httptest.NewRecorder()
+	s.getUploads(w, req)
+	ups := []upload.Upload{}
+	json.NewDecoder(w.Result().Body).Decode(&ups)
+	if w.Result().Header.Get("X-Total-Count") != "3" || len(ups) != 2 || ups[0].State != upload.StateSkipped {
+		t.Errorf("unexpected uploads %#v", ups)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/rest/uploads?filter=bogus", nil)
+	w = httptest.NewRecorder()
+	s.getUploads(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Error("bad filter should be rejected")
+	}
+}
+
+func TestModifyUploadWrongState(t *testing.T) {
+	up := upload.NewUploader()
+	up.AddFile("/nonexistent.png", config.Watcher{WebHookURL: "https://127.0.0.1/"})
+	id := up.Uploads[0].Id
+	s := WebService{Uploader: up}
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/rest/upload/%d/skip", id), nil)
+	req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(id), "change": "skip"})
+	w := httptest.NewRecorder()
+	s.modifyUpload(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Error("queued upload should not be skipped")
+	}
+	if state, _ := up.Uploads[0].CurrentState(); state != upload.StateQueued {
+		t.Errorf("upload state changed to %s", state)
+	}
+}
+
+func TestRedactUpload(t *testing.T) {
+	up := upload.NewUploader()
+	up.AddFile("/nonexistent.png", config.Watcher{WebHookURL: "https://127.0.0.1/", HoldUploads: true})
+	id := up.Uploads[0].Id
+	s := WebService{Uploader: up}
+
+	redact := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/rest/upload/%d/redact", id), strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": fmt.Sprint(id), "change": "redact"})
+		w := httptest.NewRecorder()
+		s.modifyUpload(w, req)
+		return w.Result().StatusCode
+	}
+
+	if code := redact(`[{"X":10,"Y":10,"Width":100,"Height":50,"Mode":"smudge"}]`); code != 400 {
+		t.Error("unknown redaction mode should be rejected")
+	}
+	if code := redact(`[{"X":10,"Y":10,"Width":100,"Height":50,"Mode":"blur"},{"X":0,"Y":0,"Width":5,"Height":5,"Mode":"fill","Colour":"#ff0000"}]`); code != 200 {
+		t.Errorf("redactions should be accepted, got %d", code)
+	}
+	if n := len(up.Uploads[0].Image.Redactions); n != 2 {
+		t.Errorf("expected 2 redactions, got %d", n)
+	}
+}
+
+func TestImageThumb(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tiny.png")
+	im := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	png.Encode(f, im)
+	f.Close()
+
+	up := upload.NewUploader()
+	up.AddFile(file, config.Watcher{WebHookURL: "https://127.0.0.1/", HoldUploads: true})
+	id := fmt.Sprint(up.Uploads[0].Id)
+	s := WebService{Uploader: up}
+
+	thumb := func(query, etag string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/rest/image/"+id+"/thumb"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		s.imageThumb(w, req)
+		return w.Result()
+	}
+
+	resp := thumb("", "")
+	if resp.StatusCode != 200 {
+		t.Fatalf("small image thumbnail failed with %d", resp.StatusCode)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Cache-Control") == "" {
+		t.Error("no caching headers")
+	}
+	if conf, _, err := image.DecodeConfig(resp.Body); err != nil || conf.Width != 40 {
+		t.Errorf("wrong thumbnail, %v %v", conf, err)
+	}
+
+	if resp := thumb("", etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected not modified, got %d", resp.StatusCode)
+	}
+	resp = thumb("?size=16", etag)
+	if resp.StatusCode != 200 {
+		t.Fatalf("thumbnail at size 16 failed with %d", resp.StatusCode)
+	}
+	if conf, _, err := image.DecodeConfig(resp.Body); err != nil || conf.Width != 16 || conf.Height != 8 {
+		t.Errorf("wrong thumbnail size, %v %v", conf, err)
+	}
+	if resp := thumb("?size=5000", ""); resp.StatusCode != 400 {
+		t.Errorf("bad size should be rejected, got %d", resp.StatusCode)
+	}
+
+	// thumbnails can be fetched while the upload is edited, this is for
+	// go test -race
+	done := make(chan bool)
+	go func() {
+		for n := 0; n < 10; n++ {
+			up.Uploads[0].Modify(func(s *dauimage.Store) {
+				s.Redactions = []dauimage.Redaction{{X: float64(n), Y: 0, Width: 5, Height: 5, Mode: dauimage.RedactFill}}
+			})
+		}
+		close(done)
+	}()
+	for n := 0; n < 10; n++ {
+		if resp := thumb("", ""); resp.StatusCode != 200 {
+			t.Errorf("thumbnail failed with %d", resp.StatusCode)
+		}
+	}
+	<-done
+}
+
+func TestCollageUploads(t *testing.T) {
+	dir := t.TempDir()
+	up := upload.NewUploader()
+	for n := 0; n < 2; n++ {
+		file := filepath.Join(dir, fmt.Sprintf("shot%d.png", n))
+		f, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		png.Encode(f, image.NewRGBA(image.Rect(0, 0, 40, 20)))
+		f.Close()
+		up.AddFile(file, config.Watcher{WebHookURL: "https://127.0.0.1/", HoldUploads: true})
+	}
+	s := WebService{Uploader: up}
+
+	collage := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/rest/uploads/collage", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		s.collageUploads(w, req)
+		return w.Result().StatusCode
+	}
+
+	ids := fmt.Sprintf("[%d, %d]", up.Uploads[0].Id, up.Uploads[1].Id)
+	if code := collage(`{"ids": ` + ids + `, "columns": -1}`); code != 400 {
+		t.Error("negative columns should be rejected")
+	}
+	if code := collage(`{"ids": [12345, 12346]}`); code != 400 {
+		t.Error("unknown uploads should be rejected")
+	}
+	if code := collage(`{"ids": ` + ids + `, "instead": true, "captions": true}`); code != 200 {
+		t.Fatalf("collage failed with %d", code)
+	}
+	if len(up.Uploads) != 3 || len(up.Uploads[0].Collage) != 2 {
+		t.Fatal("collage was not added")
+	}
+	os.Remove(up.Uploads[0].Image.OriginalFilename)
+}
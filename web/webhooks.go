@@ -0,0 +1,107 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/tardisx/discord-auto-upload/config"
+	"github.com/tardisx/discord-auto-upload/upload"
+)
+
+// WebhookValidation is the result of checking a single webhook with discord.
+type WebhookValidation struct {
+	Watcher   int    `json:"watcher"` // index into the config Watchers
+	Path      string `json:"path"`
+	URL       string `json:"url"`
+	Name      string `json:"name,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+	GuildID   string `json:"guild_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type WebhookValidationResponse struct {
+	Webhooks []WebhookValidation `json:"webhooks"`
+}
+
+// validateWebhooks checks each webhook in newConfig which is not present in
+// oldConfig. Webhooks which do not look like URLs are skipped, as saving
+// the configuration will reject them anyway.
+func validateWebhooks(oldConfig *config.ConfigV3, newConfig *config.ConfigV3) []WebhookValidation {
+	known := map[string]bool{}
+	if oldConfig != nil {
+		for _, w := range oldConfig.Watchers {
+			for _, url := range watcherWebhooks(w) {
+				known[url] = true
+			}
+		}
+	}
+
+	results := []WebhookValidation{}
+	checked := map[string]WebhookValidation{}
+	for i, w := range newConfig.Watchers {
+		for _, url := range watcherWebhooks(w) {
+			if known[url] || !config.ValidWebhookURL(url) {
+				continue
+			}
+			res, ok := checked[url]
+			if !ok {
+				res = WebhookValidation{URL: url}
+				info, err := upload.ValidateWebhook(url)
+				if err != nil {
+					res.Error = err.Error()
+				} else {
+					res.Name = info.Name
+					res.ChannelID = info.ChannelID
+					res.GuildID = info.GuildID
+				}
+				checked[url] = res
+			}
+			res.Watcher = i
+			res.Path = w.Path
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+// watcherWebhooks returns every webhook a watcher might upload to.
+func watcherWebhooks(w config.Watcher) []string {
+	urls := []string{}
+	for _, d := range w.AllDestinations() {
+		urls = append(urls, d.WebHookURL)
+	}
+	for _, r := range w.Rules {
+		urls = append(urls, r.WebHookURL)
+	}
+	return urls
+}
+
+// handleValidateWebhooks checks the new or changed webhooks in the posted
+// configuration, without saving it.
+func (ws *WebService) handleValidateWebhooks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method != "POST" {
+		returnJSONError(w, "bad request")
+		return
+	}
+
+	newConfig := config.ConfigV3{}
+
+	defer r.Body.Close()
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		returnJSONError(w, "could not read body?")
+		return
+	}
+	err = json.Unmarshal(b, &newConfig)
+	if err != nil {
+		returnJSONError(w, "badly formed JSON")
+		return
+	}
+
+	res := WebhookValidationResponse{Webhooks: validateWebhooks(ws.Config.Config, &newConfig)}
+	resString, _ := json.Marshal(res)
+	w.Write(resString)
+}